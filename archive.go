@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Uploads original recordings to an S3-compatible bucket, since Twilio only
+// keeps them around until they are deleted from the account.
+type archiver struct {
+	client *minio.Client
+	bucket string
+}
+
+func newArchiver(cfg config) (*archiver, error) {
+	client, err := minio.New(cfg.ArchiveEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.ArchiveAccessKeyId, cfg.ArchiveSecretAccessKey, ""),
+		Region: cfg.ArchiveRegion,
+		Secure: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &archiver{client: client, bucket: cfg.ArchiveBucket}, nil
+}
+
+// Stores the recording under a key built from the current date and the
+// recording's sid, e.g. 2023/01/31/RE123.wav.
+func (a *archiver) archive(ctx context.Context, sid string, recording io.Reader, size int64) error {
+	defer timer(ctx, "archive recording")()
+
+	key := time.Now().Format("2006/01/02/") + sid + ".wav"
+	_, err := a.client.PutObject(ctx, a.bucket, key, recording, size, minio.PutObjectOptions{
+		ContentType: "audio/wav",
+	})
+	return err
+}
+
+// Stores a transcript as text alongside its recording, e.g. 2023/01/31/RE123.txt
+func (a *archiver) archiveTranscript(ctx context.Context, sid, transcript string) error {
+	key := time.Now().Format("2006/01/02/") + sid + ".txt"
+	_, err := a.client.PutObject(ctx, a.bucket, key, strings.NewReader(transcript), int64(len(transcript)), minio.PutObjectOptions{
+		ContentType: "text/plain; charset=utf-8",
+	})
+	return err
+}
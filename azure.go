@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/pkg/errors"
+)
+
+// Largest file Azure's fast transcription API accepts
+const azureMaxBytes = 300 << 20
+
+// Transcribes with Azure AI Speech's fast transcription API
+type azureTranscriber struct {
+	region string
+	key    string
+	locale string
+	// Labels who said what, for recordings with more than one speaker on
+	// the same channel
+	conversation bool
+	client       *http.Client
+}
+
+type azureResponse struct {
+	CombinedPhrases []struct {
+		Text string `json:"text"`
+	} `json:"combinedPhrases"`
+	Phrases []struct {
+		Speaker              int     `json:"speaker"`
+		OffsetMilliseconds   int64   `json:"offsetMilliseconds"`
+		DurationMilliseconds int64   `json:"durationMilliseconds"`
+		Text                 string  `json:"text"`
+		Locale               string  `json:"locale"`
+		Confidence           float64 `json:"confidence"`
+	} `json:"phrases"`
+}
+
+// The language, if set, replaces the configured locale. Normalization,
+// chunking, and thread options are specific to the local model.
+func (t azureTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "azure transcription")()
+
+	if recording.Size() > azureMaxBytes {
+		return transcriptResult{}, fmt.Errorf("recording too large for azure: %d bytes", recording.Size())
+	}
+	locale := t.locale
+	if opts.Language != "" {
+		locale = opts.Language
+	}
+	definition := map[string]interface{}{"locales": []string{locale}}
+	if t.conversation {
+		definition["diarization"] = map[string]interface{}{"enabled": true, "maxSpeakers": 2}
+	}
+	definitionJson, err := json.Marshal(definition)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, err := form.CreateFormFile("audio", "recording.wav")
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	if _, err := io.Copy(file, io.NewSectionReader(recording, 0, recording.Size())); err != nil {
+		return transcriptResult{}, err
+	}
+	form.WriteField("definition", string(definitionJson))
+	if err := form.Close(); err != nil {
+		return transcriptResult{}, err
+	}
+
+	url := fmt.Sprintf("https://%s.api.cognitive.microsoft.com/speechtotext/transcriptions:transcribe?api-version=2024-11-15", t.region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	req.Header.Set("Ocp-Apim-Subscription-Key", t.key)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return transcriptResult{}, fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	var parsed azureResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return transcriptResult{}, errors.Wrap(err, "parse azure response failed")
+	}
+
+	// Speakers get a paragraph each time they start talking, like channels
+	// do when speakers are separated
+	var confidence float64
+	var paragraphs []string
+	var segments []timedSegment
+	speaker := 0
+	for _, phrase := range parsed.Phrases {
+		confidence += phrase.Confidence / float64(len(parsed.Phrases))
+		s := whisper.Segment{
+			Start: time.Duration(phrase.OffsetMilliseconds) * time.Millisecond,
+			End:   time.Duration(phrase.OffsetMilliseconds+phrase.DurationMilliseconds) * time.Millisecond,
+			Text:  phrase.Text,
+		}
+		segments = append(segments, newTimedSegment(s))
+		if opts.OnSegment != nil {
+			opts.OnSegment(s)
+		}
+		if !t.conversation {
+			continue
+		}
+		if phrase.Speaker != speaker || len(paragraphs) == 0 {
+			speaker = phrase.Speaker
+			paragraphs = append(paragraphs, fmt.Sprintf("Speaker %d: %s", speaker, phrase.Text))
+		} else {
+			paragraphs[len(paragraphs)-1] += " " + phrase.Text
+		}
+	}
+	if len(parsed.Phrases) == 0 {
+		confidence = 1
+	}
+
+	text := strings.Join(paragraphs, "\n\n")
+	if !t.conversation {
+		var texts []string
+		for _, combined := range parsed.CombinedPhrases {
+			texts = append(texts, strings.TrimSpace(combined.Text))
+		}
+		text = strings.Join(texts, " ")
+	}
+	language := opts.Language
+	if language == "" && len(parsed.Phrases) > 0 {
+		language = parsed.Phrases[0].Locale
+	}
+	return transcriptResult{Text: strings.TrimSpace(text), Confidence: confidence, Language: language, Segments: segments}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a cancelled call is remembered, which only needs to cover the gap
+// between the record action and the recording status callback
+const cancelledCallTTL = time.Hour
+
+// Tracks calls whose recording was discarded with the cancel key. Twilio only
+// reports the key in the record action request, not in the recording status
+// callback, so the two are matched up by CallSid.
+type cancelledCalls struct {
+	mu    sync.Mutex
+	calls map[string]time.Time
+}
+
+func newCancelledCalls() *cancelledCalls {
+	return &cancelledCalls{calls: map[string]time.Time{}}
+}
+
+func (cc *cancelledCalls) add(callSid string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now()
+	for sid, at := range cc.calls {
+		if now.Sub(at) > cancelledCallTTL {
+			delete(cc.calls, sid)
+		}
+	}
+	cc.calls[callSid] = now
+}
+
+func (cc *cancelledCalls) has(callSid string) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	_, ok := cc.calls[callSid]
+	return ok
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest date expression, in words, that is tried after a date phrase
+const maxDateWords = 5
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+var months = map[string]time.Month{
+	"january":   time.January,
+	"february":  time.February,
+	"march":     time.March,
+	"april":     time.April,
+	"may":       time.May,
+	"june":      time.June,
+	"july":      time.July,
+	"august":    time.August,
+	"september": time.September,
+	"october":   time.October,
+	"november":  time.November,
+	"december":  time.December,
+}
+
+var numberWords = map[string]int{
+	"a": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5,
+	"six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10,
+}
+
+// Looks for one of phrases at the start of the transcript followed by a
+// spoken date, like "for yesterday" or "this happened on March 3rd". Returns
+// the date and the transcript with the phrase and date removed. If a phrase
+// is found but the date can't be understood, now and the unmodified transcript
+// are returned, and ok is false.
+func parseSpokenDate(transcript string, phrases []string, now time.Time) (date time.Time, body string, matched, ok bool) {
+	trimmed := strings.TrimSpace(transcript)
+	for _, phrase := range phrases {
+		phrase = strings.TrimSpace(phrase)
+		if phrase == "" || len(trimmed) <= len(phrase) {
+			continue
+		}
+		if !strings.EqualFold(trimmed[:len(phrase)], phrase) || trimmed[len(phrase)] != ' ' {
+			continue
+		}
+
+		words := strings.Fields(trimmed[len(phrase):])
+		n := len(words)
+		if n > maxDateWords {
+			n = maxDateWords
+		}
+		for ; n > 0; n-- {
+			expr := strings.Join(words[:n], " ")
+			if date, ok := parseDateExpr(expr, now); ok {
+				return date, capitalizeFirst(strings.Join(words[n:], " ")), true, true
+			}
+		}
+		return now, transcript, true, false
+	}
+	return now, transcript, false, false
+}
+
+// Parses a relative or absolute date expression, relative to now
+func parseDateExpr(expr string, now time.Time) (time.Time, bool) {
+	expr = strings.ToLower(strings.TrimRightFunc(expr, unicode.IsPunct))
+	words := strings.Fields(expr)
+	if len(words) > 0 && words[0] == "on" {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return time.Time{}, false
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch strings.Join(words, " ") {
+	case "today", "this morning", "this afternoon", "this evening", "tonight":
+		return today, true
+	case "yesterday", "last night":
+		return today.AddDate(0, 0, -1), true
+	case "the day before yesterday":
+		return today.AddDate(0, 0, -2), true
+	}
+
+	// "three days ago"
+	if len(words) == 3 && words[1] == "days" && words[2] == "ago" {
+		if n, ok := parseNumber(words[0]); ok {
+			return today.AddDate(0, 0, -n), true
+		}
+	}
+
+	// "monday" or "last monday"
+	last := false
+	if len(words) == 2 && words[0] == "last" {
+		last = true
+		words = words[1:]
+	}
+	if len(words) == 1 {
+		if weekday, ok := weekdays[words[0]]; ok {
+			days := (int(today.Weekday()) - int(weekday) + 7) % 7
+			if days == 0 && last {
+				days = 7
+			}
+			return today.AddDate(0, 0, -days), true
+		}
+	}
+	if last {
+		return time.Time{}, false
+	}
+
+	return parseCalendarDate(words, today)
+}
+
+// Parses "march 3", "march 3rd 2022", "3 march", or "the 3rd of march". When
+// no year is given, the most recent such date that isn't in the future is used.
+func parseCalendarDate(words []string, today time.Time) (time.Time, bool) {
+	var filtered []string
+	for _, word := range words {
+		if word != "the" && word != "of" {
+			filtered = append(filtered, strings.TrimRight(word, ","))
+		}
+	}
+	if len(filtered) < 2 || len(filtered) > 3 {
+		return time.Time{}, false
+	}
+
+	month, monthFirst := months[filtered[0]]
+	dayWord := filtered[1]
+	if !monthFirst {
+		var ok bool
+		if month, ok = months[filtered[1]]; !ok {
+			return time.Time{}, false
+		}
+		dayWord = filtered[0]
+	}
+	day, ok := parseOrdinal(dayWord)
+	if !ok || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+
+	year := today.Year()
+	if len(filtered) == 3 {
+		var err error
+		if year, err = strconv.Atoi(filtered[2]); err != nil {
+			return time.Time{}, false
+		}
+	}
+
+	date := time.Date(year, month, day, 0, 0, 0, 0, today.Location())
+	if date.Day() != day {
+		// Rolled over into the next month, e.g. February 30th
+		return time.Time{}, false
+	}
+	if len(filtered) == 2 && date.After(today) {
+		date = date.AddDate(-1, 0, 0)
+	}
+	return date, true
+}
+
+func parseNumber(word string) (int, bool) {
+	if n, ok := numberWords[word]; ok {
+		return n, true
+	}
+	n, err := strconv.Atoi(word)
+	return n, err == nil
+}
+
+// Parses "3", "3rd", or "third"
+func parseOrdinal(word string) (int, bool) {
+	for _, suffix := range []string{"st", "nd", "rd", "th"} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(word, suffix)); err == nil {
+			return n, true
+		}
+	}
+	for n, ordinal := range ordinalWords {
+		if word == ordinal {
+			return n + 1, true
+		}
+	}
+	return 0, false
+}
+
+var ordinalWords = []string{
+	"first", "second", "third", "fourth", "fifth", "sixth", "seventh",
+	"eighth", "ninth", "tenth", "eleventh", "twelfth", "thirteenth",
+	"fourteenth", "fifteenth", "sixteenth", "seventeenth", "eighteenth",
+	"nineteenth", "twentieth", "twenty-first", "twenty-second",
+	"twenty-third", "twenty-fourth", "twenty-fifth", "twenty-sixth",
+	"twenty-seventh", "twenty-eighth", "twenty-ninth", "thirtieth",
+	"thirty-first",
+}
+
+func capitalizeFirst(s string) string {
+	s = strings.TrimLeftFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// Names the day, ISO week, or month the date falls in, e.g. 2023-01-31,
+// 2023-W05, or 2023-01
+func entryGroup(groupBy string, date time.Time) string {
+	switch groupBy {
+	case "week":
+		year, week := date.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		return date.Format("2006-01")
+	default:
+		return date.Format("2006-01-02")
+	}
+}
+
+// An IANA time zone name, loaded when the config is parsed so that a typo
+// fails at startup
+type timezone struct {
+	*time.Location
+}
+
+func (tz *timezone) UnmarshalText(text []byte) error {
+	loc, err := time.LoadLocation(string(text))
+	if err != nil {
+		return err
+	}
+	tz.Location = loc
+	return nil
+}
+
+// Returns the configured location, or the server's local time zone if none
+// was configured
+func (tz timezone) loc() *time.Location {
+	if tz.Location == nil {
+		return time.Local
+	}
+	return tz.Location
+}
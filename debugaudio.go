@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Writes recordings exactly as they're given to Whisper, named by their
+// recording's sid, so that bad transcriptions can be listened to. The oldest
+// files are deleted to keep the directory under maxBytes.
+func saveDebugAudio(dir string, maxBytes int64, sid string, prepared []*bytes.Reader) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return errors.Wrap(err, "create debug audio dir failed")
+	}
+	if !recordingSidPattern.MatchString(sid) {
+		return errors.Errorf("invalid recording sid: %q", sid)
+	}
+	for i, r := range prepared {
+		name := sid + ".wav"
+		if len(prepared) > 1 {
+			name = sid + "-" + speakerLabels[i:i+1] + ".wav"
+		}
+		// Read through a section reader so the recording's own offset is
+		// left for transcription
+		data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			return err
+		}
+	}
+	return pruneDebugAudio(dir, maxBytes)
+}
+
+// Deletes the oldest recordings until the rest fit in maxBytes
+func pruneDebugAudio(dir string, maxBytes int64) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var recordings []os.FileInfo
+	var total int64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".wav") {
+			continue
+		}
+		recordings = append(recordings, file)
+		total += file.Size()
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ModTime().Before(recordings[j].ModTime())
+	})
+	for _, file := range recordings {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
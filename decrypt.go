@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// An RSA private key, read from the PEM file named in the config, matching the
+// public key registered with Twilio for recording encryption
+type privateKey struct {
+	*rsa.PrivateKey
+}
+
+func (k *privateKey) UnmarshalText(path []byte) error {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM block found in private key file")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		k.PrivateKey = key
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("private key is not an RSA key")
+	}
+	k.PrivateKey = rsaKey
+	return nil
+}
+
+// The EncryptionDetails parameter of the recording status callback
+type encryptionDetails struct {
+	Type         string `json:"type"`
+	PublicKeySid string `json:"public_key_sid"`
+	EncryptedCek string `json:"encrypted_cek"`
+	Iv           string `json:"iv"`
+}
+
+// Decrypts a recording encrypted with the "rsa-aes" scheme: the content
+// encryption key is encrypted with RSA-OAEP, and the recording with AES-GCM
+// under that key
+func decryptRecording(key *rsa.PrivateKey, rawDetails string, data []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("recording is encrypted, but no private key is configured")
+	}
+	var details encryptionDetails
+	if err := json.Unmarshal([]byte(rawDetails), &details); err != nil {
+		return nil, err
+	}
+	if details.Type != "rsa-aes" {
+		return nil, fmt.Errorf("unsupported encryption type: %q", details.Type)
+	}
+
+	encryptedCek, err := base64.StdEncoding.DecodeString(details.EncryptedCek)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.StdEncoding.DecodeString(details.Iv)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := rsa.DecryptOAEP(sha256.New(), nil, key, encryptedCek, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, data, nil)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Remembers which recordings have already been accepted, so that a status
+// callback Twilio redelivers doesn't create a second entry. With a path, the
+// SIDs are kept on disk so that redeliveries across a restart are caught too.
+type recordingDedup struct {
+	mu   sync.Mutex
+	path string
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newRecordingDedup(path string, ttl time.Duration) (*recordingDedup, error) {
+	d := &recordingDedup{path: path, ttl: ttl, seen: map[string]time.Time{}}
+	if path == "" {
+		return d, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read dedup file failed")
+	}
+	if err := json.Unmarshal(data, &d.seen); err != nil {
+		return nil, errors.Wrap(err, "parse dedup file failed")
+	}
+	return d, nil
+}
+
+// Marks the recording as seen. Returns false if it was already seen within
+// the TTL. An error means the SID is only remembered until the next restart.
+func (d *recordingDedup) add(sid string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for seenSid, at := range d.seen {
+		if now.Sub(at) > d.ttl {
+			delete(d.seen, seenSid)
+		}
+	}
+	if _, ok := d.seen[sid]; ok {
+		return false, nil
+	}
+	d.seen[sid] = now
+	return true, d.write()
+}
+
+// Forgets the recording, for when it was seen but couldn't be accepted
+func (d *recordingDedup) remove(sid string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, sid)
+	return d.write()
+}
+
+func (d *recordingDedup) write() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(d.seen)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
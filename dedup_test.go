@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordingDedupAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+
+	dedup, err := newRecordingDedup(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sid := range []string{"RE1", "RE2"} {
+		if added, err := dedup.add(sid); err != nil || !added {
+			t.Fatalf("add(%s) = %t, %v, want true", sid, added, err)
+		}
+	}
+	if added, _ := dedup.add("RE1"); added {
+		t.Error("redelivered RE1 was added again")
+	}
+	// Dropped from the queue, so Twilio's retry should get through
+	if err := dedup.remove("RE2"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := newRecordingDedup(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := restarted.add("RE1"); err != nil || added {
+		t.Errorf("add(RE1) after restart = %t, %v, want false", added, err)
+	}
+	if added, err := restarted.add("RE2"); err != nil || !added {
+		t.Errorf("add(RE2) after restart = %t, %v, want true", added, err)
+	}
+}
+
+func TestRecordingDedupExpires(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+
+	dedup, err := newRecordingDedup(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.add("RE1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	restarted, err := newRecordingDedup(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := restarted.add("RE1"); err != nil || !added {
+		t.Errorf("add(RE1) after the TTL = %t, %v, want true", added, err)
+	}
+}
+
+func TestRecordingDedupWithoutFile(t *testing.T) {
+	dedup, err := newRecordingDedup("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := dedup.add("RE1"); err != nil || !added {
+		t.Fatalf("add(RE1) = %t, %v, want true", added, err)
+	}
+	if added, _ := dedup.add("RE1"); added {
+		t.Error("redelivered RE1 was added again")
+	}
+}
+
+func TestRecordingDedupCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRecordingDedup(path, time.Hour); err == nil {
+		t.Error("loaded a corrupt dedup file, want an error")
+	}
+}
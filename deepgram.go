@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const deepgramUrl = "https://api.deepgram.com/v1/listen"
+
+// Transcribes with Deepgram's hosted API
+type deepgramTranscriber struct {
+	apiKey      string
+	model       string
+	smartFormat bool
+	punctuate   bool
+	fromTwilio  bool
+	client      *http.Client
+}
+
+type deepgramResponse struct {
+	Results struct {
+		Channels []struct {
+			DetectedLanguage string `json:"detected_language"`
+			Alternatives     []struct {
+				Transcript string  `json:"transcript"`
+				Confidence float64 `json:"confidence"`
+			} `json:"alternatives"`
+		} `json:"channels"`
+	} `json:"results"`
+}
+
+// Only the language and vocabulary are passed on. Normalization, chunking, and
+// thread options are specific to the local model.
+func (t deepgramTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "deepgram transcription")()
+
+	body := io.NewSectionReader(recording, 0, recording.Size())
+	return t.listen(ctx, "audio/wav", body, opts)
+}
+
+// Has Deepgram fetch the recording from Twilio itself, which only works if
+// Twilio doesn't require authentication for recordings and the recording isn't
+// encrypted
+func (t deepgramTranscriber) TranscribeUrl(ctx context.Context, recordingUrl string, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "deepgram transcription")()
+
+	body, err := json.Marshal(map[string]string{"url": recordingUrl})
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	return t.listen(ctx, "application/json", bytes.NewReader(body), opts)
+}
+
+func (t deepgramTranscriber) fetchesRecordings() bool {
+	return t.fromTwilio
+}
+
+func (t deepgramTranscriber) listen(ctx context.Context, contentType string, body io.Reader, opts transcribeOptions) (transcriptResult, error) {
+	query := url.Values{}
+	query.Set("model", t.model)
+	query.Set("smart_format", strconv.FormatBool(t.smartFormat))
+	query.Set("punctuate", strconv.FormatBool(t.punctuate))
+	if opts.Language != "" {
+		query.Set("language", opts.Language)
+	} else {
+		query.Set("detect_language", "true")
+	}
+	for _, keyword := range opts.Vocabulary {
+		query.Add("keywords", keyword)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, deepgramUrl+"?"+query.Encode(), body)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	req.Header.Set("Authorization", "Token "+t.apiKey)
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return transcriptResult{}, fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	var parsed deepgramResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return transcriptResult{}, errors.Wrap(err, "parse deepgram response failed")
+	}
+	if len(parsed.Results.Channels) == 0 || len(parsed.Results.Channels[0].Alternatives) == 0 {
+		return transcriptResult{}, errors.New("deepgram returned no transcript")
+	}
+
+	channel := parsed.Results.Channels[0]
+	language := opts.Language
+	if language == "" {
+		language = channel.DetectedLanguage
+	}
+	return transcriptResult{
+		Text:       strings.TrimSpace(channel.Alternatives[0].Transcript),
+		Confidence: channel.Alternatives[0].Confidence,
+		Language:   language,
+	}, nil
+}
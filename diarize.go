@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/pkg/errors"
+)
+
+// A stretch of a recording spoken by one speaker, as returned by the
+// diarization service. Times are in seconds.
+type speakerTurn struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Speaker string  `json:"speaker"`
+}
+
+// Asks the diarization service at DIARIZATION_URL who spoke when. It's given
+// the prepared WAV and answers with {"segments": [{"start", "end", "speaker"}]},
+// which is what a thin wrapper around pyannote or similar would return.
+func diarizeRecording(ctx context.Context, cfg config, recording *bytes.Reader) ([]speakerTurn, error) {
+	defer timer(ctx, "diarize recording")()
+
+	body := io.NewSectionReader(recording, 0, recording.Size())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.DiarizationUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "audio/wav")
+
+	// Like transcription, diarization only answers once it's been through
+	// the whole recording
+	res, err := cfg.speechHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	var parsed struct {
+		Segments []speakerTurn `json:"segments"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, errors.Wrap(err, "parse diarization response failed")
+	}
+	return parsed.Segments, nil
+}
+
+// Renders the transcript as a paragraph per turn, each labeled with its
+// speaker. Segments go to whichever speaker overlaps them most, or the one
+// before them if none do. Speakers are lettered in the order they first speak.
+// Returns false if fewer than two speakers were heard.
+func labelSpeakers(segments []whisper.Segment, turns []speakerTurn) (string, bool) {
+	labels := map[string]string{}
+	var paragraphs []string
+	current := ""
+	for _, segment := range segments {
+		text := strings.TrimSpace(segment.Text)
+		if text == "" {
+			continue
+		}
+		speaker, best := current, time.Duration(0)
+		for _, turn := range turns {
+			start := time.Duration(turn.Start * float64(time.Second))
+			end := time.Duration(turn.End * float64(time.Second))
+			if start < segment.Start {
+				start = segment.Start
+			}
+			if end > segment.End {
+				end = segment.End
+			}
+			if overlap := end - start; overlap > best {
+				speaker, best = turn.Speaker, overlap
+			}
+		}
+		if speaker == "" {
+			// Nothing overlaps the first segment
+			speaker = turns[0].Speaker
+		}
+		if _, ok := labels[speaker]; !ok {
+			labels[speaker] = speakerLetter(len(labels))
+		}
+		if speaker != current || len(paragraphs) == 0 {
+			paragraphs = append(paragraphs, "Speaker "+labels[speaker]+": "+text)
+			current = speaker
+		} else {
+			paragraphs[len(paragraphs)-1] += " " + text
+		}
+	}
+	if len(labels) < 2 {
+		return "", false
+	}
+	return strings.Join(paragraphs, "\n\n"), true
+}
+
+func speakerLetter(i int) string {
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return fmt.Sprint(i + 1)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Failed entries are named by their recording's SID, which is alphanumeric,
+// with a numbered suffix when a recording was split into several entries
+var failedIdPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[0-9]+)?$`)
+
+// A recording that failed somewhere in the pipeline, kept so that it can be
+// retried later. The entry is only set if the failure was in saving it.
+type failedEntry struct {
+	Id        string    `json:"id"`
+	Recording recording `json:"recording"`
+	Stage     string    `json:"stage"`
+	Entry     entry     `json:"entry"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failed_at"`
+	// Set once a retry succeeds. Resolved entries are kept on disk, but are
+	// no longer listed or retried.
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Persists failed entries as JSON files in a directory, one per recording
+type failedStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newFailedStore(dir string) (*failedStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "create failed dir failed")
+	}
+	return &failedStore{dir: dir}, nil
+}
+
+func (s *failedStore) path(id string) (string, error) {
+	if !failedIdPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid failed entry id: %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Writes the entry, replacing any earlier failure for the same recording
+func (s *failedStore) save(f failedEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(f)
+}
+
+func (s *failedStore) write(f failedEntry) error {
+	path, err := s.path(f.Id)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash can't leave a
+	// truncated entry behind
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *failedStore) read(path string) (failedEntry, error) {
+	var f failedEntry
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(data, &f)
+	return f, errors.Wrapf(err, "parse %s failed", filepath.Base(path))
+}
+
+// Returns the unresolved entries, oldest first
+func (s *failedStore) pending() ([]failedEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []failedEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		f, err := s.read(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if f.ResolvedAt == nil {
+			entries = append(entries, f)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].FailedAt.Before(entries[j].FailedAt)
+	})
+	return entries, nil
+}
+
+// Returns the entry with the given id, whether or not it's resolved
+func (s *failedStore) get(id string) (failedEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(id)
+	if err != nil {
+		return failedEntry{}, err
+	}
+	return s.read(path)
+}
+
+func (s *failedStore) resolve(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	f, err := s.read(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	f.ResolvedAt = &now
+	return s.write(f)
+}
+
+// Deletes resolved entries, along with temporary files left behind by a crash
+// mid-write, returning the number of files deleted
+func (s *failedStore) prune() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.Name())
+		switch {
+		case file.IsDir():
+			continue
+		case strings.HasSuffix(file.Name(), ".json.tmp"):
+		case strings.HasSuffix(file.Name(), ".json"):
+			f, err := s.read(path)
+			if err != nil {
+				return pruned, err
+			}
+			if f.ResolvedAt == nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
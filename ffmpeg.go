@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+)
+
+// Passed to convertRecording to mix all of the recording's channels down
+const allChannels = -1
+
+// Shells out to ffmpeg to convert a recording in any format ffmpeg understands
+// into a 16kHz mono WAV file, either mixing all channels down or keeping just
+// the one given, counting from zero. The input and output go through
+// temporary files rather than pipes, since containers like m4a need a
+// seekable input and the WAV header can only be finalized on a seekable
+// output.
+func convertRecording(ctx context.Context, ffmpegPath string, recording io.Reader, channel int) (*bytes.Reader, error) {
+	defer timer(ctx, "convert recording")()
+
+	dir, err := os.MkdirTemp("", "phone-journal-ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "input")
+	outPath := filepath.Join(dir, "output.wav")
+
+	in, err := os.Create(inPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(in, recording); err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err := in.Close(); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-i", inPath,
+	}
+	if channel != allChannels {
+		args = append(args, "-af", fmt.Sprintf("pan=mono|c0=c%d", channel))
+	}
+	args = append(args,
+		"-ac", strconv.Itoa(whisperNumChans),
+		"-ar", strconv.Itoa(whisper.SampleRate),
+		"-c:a", "pcm_s16le",
+		outPath,
+	)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	converted, err := os.ReadFile(outPath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(converted), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Used when filler removal is enabled without a word list. Words like "like"
+// and "so" are left out since they're usually meant.
+var defaultFillers = []string{"um", "umm", "uh", "uhh", "er", "erm", "hmm"}
+
+var (
+	spaceBeforePunct = regexp.MustCompile(`[ \t]+([.,!?;:])`)
+	repeatedSpaces   = regexp.MustCompile(`[ \t]{2,}`)
+)
+
+// Removes whole-word, case-insensitive matches of fillers from the transcript,
+// along with the commas that set them off, so that "I, um, went" becomes "I
+// went". Newlines are kept.
+func removeFillers(transcript string, fillers []string) string {
+	if len(fillers) == 0 {
+		fillers = defaultFillers
+	}
+	var quoted []string
+	for _, filler := range fillers {
+		if words := strings.Fields(filler); len(words) > 0 {
+			for i, word := range words {
+				words[i] = regexp.QuoteMeta(word)
+			}
+			quoted = append(quoted, strings.Join(words, `\s+`))
+		}
+	}
+	if len(quoted) == 0 {
+		return transcript
+	}
+	re := regexp.MustCompile(`(?i),?([ \t]*)\b(?:` + strings.Join(quoted, "|") + `)\b,?`)
+	transcript = re.ReplaceAllString(transcript, "$1")
+	transcript = spaceBeforePunct.ReplaceAllString(transcript, "$1")
+	transcript = repeatedSpaces.ReplaceAllString(transcript, " ")
+
+	lines := strings.Split(transcript, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const gcpSpeechUrl = "https://speech.googleapis.com/v1/"
+
+// Largest inline audio Speech-to-Text accepts, about 5 minutes of 16kHz mono
+// audio. Anything longer would have to go through Cloud Storage.
+const gcpMaxBytes = 10 << 20
+
+// How often a long running recognition is checked on
+const gcpPollInterval = 2 * time.Second
+
+// Transcribes with Google Cloud Speech-to-Text, which handles some languages
+// better than the local model does
+type gcpTranscriber struct {
+	creds        *gcpCredentials
+	model        string
+	languageCode string
+	punctuation  bool
+	client       *http.Client
+}
+
+type gcpRecognizeResponse struct {
+	Results []struct {
+		Alternatives []struct {
+			Transcript string  `json:"transcript"`
+			Confidence float64 `json:"confidence"`
+		} `json:"alternatives"`
+		LanguageCode string `json:"languageCode"`
+	} `json:"results"`
+}
+
+type gcpOperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Response gcpRecognizeResponse `json:"response"`
+}
+
+// The language, if set, replaces the configured language code, and the
+// vocabulary is given as phrase hints. Normalization, chunking, and thread
+// options are specific to the local model.
+func (t gcpTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "gcp transcription")()
+
+	if recording.Size() > gcpMaxBytes {
+		return transcriptResult{}, fmt.Errorf("recording too large for gcp: %d bytes", recording.Size())
+	}
+	audio, err := ioutil.ReadAll(io.NewSectionReader(recording, 0, recording.Size()))
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	languageCode := t.languageCode
+	if opts.Language != "" {
+		languageCode = opts.Language
+	}
+	// Recordings are prepared as 16kHz mono WAV, so the header describes
+	// them, but it's spelled out anyway
+	config := map[string]interface{}{
+		"encoding":                   "LINEAR16",
+		"sampleRateHertz":            16000,
+		"languageCode":               languageCode,
+		"model":                      t.model,
+		"enableAutomaticPunctuation": t.punctuation,
+	}
+	if len(opts.Vocabulary) > 0 {
+		config["speechContexts"] = []map[string]interface{}{{"phrases": opts.Vocabulary}}
+	}
+	request := map[string]interface{}{
+		"config": config,
+		"audio": map[string]string{
+			"content": base64.StdEncoding.EncodeToString(audio),
+		},
+	}
+
+	// The synchronous API only takes a minute of audio, so recognition
+	// always runs as an operation that's polled until it's done
+	var op gcpOperation
+	if err := t.call(ctx, http.MethodPost, "speech:longrunningrecognize", request, &op); err != nil {
+		return transcriptResult{}, err
+	}
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return transcriptResult{}, ctx.Err()
+		case <-time.After(gcpPollInterval):
+		}
+		if err := t.call(ctx, http.MethodGet, "operations/"+op.Name, nil, &op); err != nil {
+			return transcriptResult{}, err
+		}
+	}
+	if op.Error != nil {
+		return transcriptResult{}, fmt.Errorf("gcp recognition failed: %d: %s", op.Error.Code, op.Error.Message)
+	}
+
+	// Results are consecutive stretches of the recording. Confidence is
+	// averaged over them.
+	var texts []string
+	var confidence float64
+	language := opts.Language
+	for _, result := range op.Response.Results {
+		if len(result.Alternatives) == 0 {
+			continue
+		}
+		texts = append(texts, strings.TrimSpace(result.Alternatives[0].Transcript))
+		confidence += result.Alternatives[0].Confidence
+		if language == "" {
+			language = result.LanguageCode
+		}
+	}
+	if len(texts) == 0 {
+		confidence = 1
+	} else {
+		confidence /= float64(len(texts))
+	}
+	return transcriptResult{Text: strings.Join(texts, " "), Confidence: confidence, Language: language}, nil
+}
+
+func (t gcpTranscriber) call(ctx context.Context, method, path string, request, response interface{}) error {
+	token, err := t.creds.accessToken(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get gcp access token failed")
+	}
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gcpSpeechUrl+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(response), "parse gcp response failed")
+}
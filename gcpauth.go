@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpScope         = "https://www.googleapis.com/auth/cloud-platform"
+	gcpTokenUrl      = "https://oauth2.googleapis.com/token"
+	gcpMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// A credentials file, either a service account key or the user credentials
+// written by gcloud auth application-default login
+type gcpCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Fetches access tokens with Google's application default credentials: the
+// file named by GOOGLE_APPLICATION_CREDENTIALS, then gcloud's default
+// credentials file, then the metadata server when running on GCP
+type gcpCredentials struct {
+	file   *gcpCredentialsFile
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func findGcpCredentials(client *http.Client) (*gcpCredentials, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		// Where gcloud writes them, if it's been logged in
+		if home, err := os.UserHomeDir(); err == nil {
+			wellKnown := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(wellKnown); err == nil {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		return &gcpCredentials{client: client}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read gcp credentials failed")
+	}
+	var file gcpCredentialsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "parse gcp credentials failed")
+	}
+	creds := &gcpCredentials{file: &file, client: client}
+	switch file.Type {
+	case "service_account":
+		if creds.key, err = parseRsaKey(file.PrivateKey); err != nil {
+			return nil, errors.Wrap(err, "parse gcp private key failed")
+		}
+		if file.TokenUri == "" {
+			file.TokenUri = gcpTokenUrl
+		}
+	case "authorized_user":
+	default:
+		return nil, fmt.Errorf("unsupported gcp credentials type: %q", file.Type)
+	}
+	return creds, nil
+}
+
+func parseRsaKey(text string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// Returns a cached access token, or fetches a new one if it's near expiry
+func (c *gcpCredentials) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expiry) > time.Minute {
+		return c.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case c.file == nil:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataToken, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	case c.key != nil:
+		var assertion string
+		if assertion, err = c.signedAssertion(); err == nil {
+			req, err = postForm(ctx, c.file.TokenUri, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		req, err = postForm(ctx, gcpTokenUrl, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.file.ClientId},
+			"client_secret": {c.file.ClientSecret},
+			"refresh_token": {c.file.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	var parsed struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return "", errors.Wrap(err, "parse gcp token failed")
+	}
+	c.token = parsed.AccessToken
+	c.expiry = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// Signs a JWT asserting the service account's identity, which is traded for
+// an access token
+func (c *gcpCredentials) signedAssertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.file.ClientEmail,
+		"scope": gcpScope,
+		"aud":   c.file.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func postForm(ctx context.Context, target string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A daily window of clock times like "06:00-23:00", parsed when the config
+// is parsed. A window whose end is before its start wraps past midnight.
+type hourRange struct {
+	// Minutes since midnight
+	start, end int
+	set        bool
+}
+
+func (r *hourRange) UnmarshalText(text []byte) error {
+	startText, endText, ok := strings.Cut(string(text), "-")
+	if !ok {
+		return fmt.Errorf("invalid hour range %q, expected HH:MM-HH:MM", text)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(startText))
+	if err != nil {
+		return fmt.Errorf("invalid hour range %q: %v", text, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(endText))
+	if err != nil {
+		return fmt.Errorf("invalid hour range %q: %v", text, err)
+	}
+	r.start = start.Hour()*60 + start.Minute()
+	r.end = end.Hour()*60 + end.Minute()
+	r.set = true
+	return nil
+}
+
+// Reports whether the clock time of t falls within the window. An unset
+// window contains every time.
+func (r hourRange) contains(t time.Time) bool {
+	if !r.set {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	outboundTransportOnce sync.Once
+	outboundTransport     *http.Transport
+
+	speechTransportOnce sync.Once
+	speechTransport     *http.Transport
+)
+
+// Returns the transport shared by every outbound request, which gives up on
+// connecting, or on waiting for a response to start, after HTTP_TIMEOUT
+func (cfg config) httpTransport() *http.Transport {
+	outboundTransportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   cfg.HTTPTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = cfg.HTTPTimeout
+		transport.ResponseHeaderTimeout = cfg.HTTPTimeout
+		outboundTransport = transport
+	})
+	return outboundTransport
+}
+
+// Returns a client for quick requests, like those to Twilio or for an access
+// token, which also limits each request as a whole, including reading the
+// response, to HTTP_TIMEOUT. Notion clients can't, since a rate-limited
+// request may wait longer than that to retry.
+func (cfg config) httpClient() *http.Client {
+	return &http.Client{Transport: cfg.httpTransport(), Timeout: cfg.HTTPTimeout}
+}
+
+// Returns a client for hosted speech services, which only start responding
+// once they've processed the audio, so a long recording can take well past
+// HTTP_TIMEOUT. Only connecting is limited to that. Each request as a whole
+// is limited to TRANSCRIBE_TIMEOUT if set, and otherwise only by its context.
+func (cfg config) speechHTTPClient() *http.Client {
+	speechTransportOnce.Do(func() {
+		transport := cfg.httpTransport().Clone()
+		transport.ResponseHeaderTimeout = 0
+		speechTransport = transport
+	})
+	return &http.Client{Transport: speechTransport, Timeout: cfg.TranscribeTimeout}
+}
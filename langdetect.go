@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	whispercpp "github.com/ggerganov/whisper.cpp/bindings/go"
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+)
+
+// Seconds of audio the language is detected from, which is all whisper looks
+// at anyway
+const detectSeconds = 30
+
+// Detects the spoken language with a model of its own. The high-level
+// bindings can only transcribe in a language they're given, so detection goes
+// through the low-level ones, which can't share the transcription model. A
+// small multilingual model, like tiny or base, is plenty.
+type languageDetector struct {
+	mu      sync.Mutex
+	ctx     *whispercpp.Context
+	threads int
+}
+
+func newLanguageDetector(file string) (*languageDetector, error) {
+	ctx := whispercpp.Whisper_init(file)
+	if ctx == nil {
+		return nil, fmt.Errorf("load language detection model failed: %s", file)
+	}
+	if ctx.Whisper_is_multilingual() == 0 {
+		ctx.Whisper_free()
+		return nil, fmt.Errorf("language detection model is english-only: %s", file)
+	}
+	// The default the bindings give transcription
+	return &languageDetector{ctx: ctx, threads: runtime.NumCPU()}, nil
+}
+
+// Returns the most likely language of the start of the recording and its
+// probability, leaving the reader at the start of the file
+func (d *languageDetector) detect(recording io.ReadSeeker) (string, float32, error) {
+	pcm, err := newPCMReader(recording, detectSeconds*whisper.SampleRate)
+	if err != nil {
+		return "", 0, err
+	}
+	samples, err := pcm.next()
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := recording.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.ctx.Whisper_pcm_to_mel(samples, d.threads); err != nil {
+		return "", 0, err
+	}
+	probs, err := d.ctx.Whisper_lang_auto_detect(0, d.threads)
+	if err != nil {
+		return "", 0, err
+	}
+	best := 0
+	for id, p := range probs {
+		if p > probs[best] {
+			best = id
+		}
+	}
+	return whispercpp.Whisper_lang_str(best), probs[best], nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "strings"
+
+// Returns the language to transcribe the caller's recordings in, or an empty
+// string to use the model's default
+func (cfg config) language(caller string) string {
+	if language, ok := cfg.CallerLanguageMap[caller]; ok {
+		return language
+	}
+	return cfg.Language
+}
+
+// Whisper's languages by the name OpenAI's API reports them under, mapped to
+// the ISO 639-1 codes the local model and other transcribers use. A few, like
+// "jw" for Javanese and "haw" for Hawaiian, are whisper's own, which the
+// local model reports too.
+var whisperLanguageCodes = map[string]string{
+	"english": "en", "chinese": "zh", "german": "de", "spanish": "es",
+	"russian": "ru", "korean": "ko", "french": "fr", "japanese": "ja",
+	"portuguese": "pt", "turkish": "tr", "polish": "pl", "catalan": "ca",
+	"dutch": "nl", "arabic": "ar", "swedish": "sv", "italian": "it",
+	"indonesian": "id", "hindi": "hi", "finnish": "fi", "vietnamese": "vi",
+	"hebrew": "he", "ukrainian": "uk", "greek": "el", "malay": "ms",
+	"czech": "cs", "romanian": "ro", "danish": "da", "hungarian": "hu",
+	"tamil": "ta", "norwegian": "no", "thai": "th", "urdu": "ur",
+	"croatian": "hr", "bulgarian": "bg", "lithuanian": "lt", "latin": "la",
+	"maori": "mi", "malayalam": "ml", "welsh": "cy", "slovak": "sk",
+	"telugu": "te", "persian": "fa", "latvian": "lv", "bengali": "bn",
+	"serbian": "sr", "azerbaijani": "az", "slovenian": "sl", "kannada": "kn",
+	"estonian": "et", "macedonian": "mk", "breton": "br", "basque": "eu",
+	"icelandic": "is", "armenian": "hy", "nepali": "ne", "mongolian": "mn",
+	"bosnian": "bs", "kazakh": "kk", "albanian": "sq", "swahili": "sw",
+	"galician": "gl", "marathi": "mr", "punjabi": "pa", "sinhala": "si",
+	"khmer": "km", "shona": "sn", "yoruba": "yo", "somali": "so",
+	"afrikaans": "af", "occitan": "oc", "georgian": "ka", "belarusian": "be",
+	"tajik": "tg", "sindhi": "sd", "gujarati": "gu", "amharic": "am",
+	"yiddish": "yi", "lao": "lo", "uzbek": "uz", "faroese": "fo",
+	"haitian creole": "ht", "pashto": "ps", "turkmen": "tk", "nynorsk": "nn",
+	"maltese": "mt", "sanskrit": "sa", "luxembourgish": "lb", "myanmar": "my",
+	"tibetan": "bo", "tagalog": "tl", "malagasy": "mg", "assamese": "as",
+	"tatar": "tt", "hawaiian": "haw", "lingala": "ln", "hausa": "ha",
+	"bashkir": "ba", "javanese": "jw", "sundanese": "su", "cantonese": "yue",
+}
+
+// Returns the code for a language whisper names in full, like "english", or
+// the language as it was if it isn't one, such as when it's already a code
+func languageCode(language string) string {
+	if code, ok := whisperLanguageCodes[strings.ToLower(strings.TrimSpace(language))]; ok {
+		return code
+	}
+	return language
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dstotijn/go-notion"
+)
+
+var errNoEntries = errors.New("no entries found")
+
+// Entries in a Notion target shared between callers don't record who made
+// them, so the latest one may well be someone else's
+var errSharedTarget = errors.New("caller shares their notion target")
+
+// Reports whether the transcript consists of nothing but the phrase, ignoring
+// case and punctuation, so that a command mentioned in passing isn't acted on
+func isSpokenCommand(transcript, phrase string) bool {
+	normalize := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			if unicode.IsPunct(r) {
+				return -1
+			}
+			return unicode.ToLower(r)
+		}, s)
+		return strings.Join(strings.Fields(s), " ")
+	}
+	phrase = normalize(phrase)
+	return phrase != "" && normalize(transcript) == phrase
+}
+
+// Archives the most recently created entry in the caller's Notion target and
+// returns its id. Callers sharing their target get errSharedTarget rather
+// than archiving an entry that may not be theirs.
+func archiveLatestEntry(ctx context.Context, cfg config, caller string) (string, error) {
+	defer timer(ctx, "archive latest entry")()
+
+	if !cfg.ownsNotionTarget(caller) {
+		return "", errSharedTarget
+	}
+	target := cfg.notionTarget(caller)
+	notionClient := cfg.notionClient(target.Token)
+	id, _, err := latestEntry(ctx, cfg, notionClient, target)
+	if err != nil {
+		return "", err
+	}
+
+	archived := true
+	_, err = notionClient.UpdatePage(ctx, id, notion.UpdatePageParams{Archived: &archived})
+	return id, err
+}
+
+// Returns the id and title of the most recently created entry in the target
+func latestEntry(ctx context.Context, cfg config, notionClient *notion.Client, target notionTarget) (id, title string, err error) {
+	if cfg.NotionParentType == "page" {
+		return latestChildPage(ctx, notionClient, target.PageId)
+	}
+	return latestDatabasePage(ctx, notionClient, target.DatabaseId)
+}
+
+func latestDatabasePage(ctx context.Context, notionClient *notion.Client, databaseId string) (string, string, error) {
+	query := &notion.DatabaseQuery{
+		Sorts: []notion.DatabaseQuerySort{
+			{Timestamp: notion.SortTimeStampCreatedTime, Direction: notion.SortDirDesc},
+		},
+		PageSize: 10,
+	}
+	for {
+		result, err := notionClient.QueryDatabase(ctx, databaseId, query)
+		if err != nil {
+			return "", "", err
+		}
+		for _, page := range result.Results {
+			if title := pageTitle(page); isEntryTitle(title) {
+				return page.ID, title, nil
+			}
+		}
+		if !result.HasMore || result.NextCursor == nil {
+			return "", "", errNoEntries
+		}
+		query.StartCursor = *result.NextCursor
+	}
+}
+
+// Daily summaries and placeholders for recordings still being transcribed
+// share the entries' parent, but aren't entries
+func isEntryTitle(title string) bool {
+	return !strings.HasPrefix(title, summaryTitlePrefix) && !strings.HasPrefix(title, placeholderTitlePrefix)
+}
+
+// Child pages are listed in the order they were created, so the latest entry
+// is the last one
+func latestChildPage(ctx context.Context, notionClient *notion.Client, pageId string) (string, string, error) {
+	var id, title string
+	query := &notion.PaginationQuery{}
+	for {
+		result, err := notionClient.FindBlockChildrenByID(ctx, pageId, query)
+		if err != nil {
+			return "", "", err
+		}
+		for _, block := range result.Results {
+			if childPage, ok := block.(*notion.ChildPageBlock); ok && isEntryTitle(childPage.Title) {
+				id, title = block.ID(), childPage.Title
+			}
+		}
+		if !result.HasMore || result.NextCursor == nil {
+			break
+		}
+		query.StartCursor = *result.NextCursor
+	}
+	if id == "" {
+		return "", "", errNoEntries
+	}
+	return id, title, nil
+}
+
+// How long the greeting waits on Notion before giving up on the last entry,
+// since the caller is listening to silence in the meantime
+const lastEntryTimeout = 3 * time.Second
+
+// Returns the title of the caller's latest entry to remind them of in the
+// greeting, or an empty string if there isn't one or it can't be fetched. As
+// with isFirstTimeCaller, the local index is preferred, and without one only
+// callers who own their Notion target are looked up.
+func lastEntryTitle(ctx context.Context, cfg config, index *sqliteStore, caller string) string {
+	ctx, cancel := context.WithTimeout(ctx, lastEntryTimeout)
+	defer cancel()
+
+	var title string
+	var err error
+	if index != nil {
+		title, err = index.latestTitle(ctx, caller)
+	} else if cfg.ownsNotionTarget(caller) && cfg.usesStore("notion") {
+		target := cfg.notionTarget(caller)
+		_, title, err = latestEntry(ctx, cfg, cfg.notionClient(target.Token), target)
+	} else {
+		return ""
+	}
+	if err != nil {
+		if err != errNoEntries {
+			logf(ctx, "fetch last entry failed: %v", err)
+		}
+		return ""
+	}
+	title = strings.TrimSuffix(strings.TrimPrefix(title, lowConfidenceFlag), "...")
+	return strings.TrimRightFunc(title, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+}
+
+// Reports whether the caller has never saved an entry, preferring the local
+// index since it knows who made each entry. Without one, only callers who own
+// their Notion target can be checked, since entries in a shared target don't
+// record who made them. Anything that can't be checked counts as a
+// returning caller.
+func isFirstTimeCaller(ctx context.Context, cfg config, index *sqliteStore, caller string) bool {
+	ctx, cancel := context.WithTimeout(ctx, lastEntryTimeout)
+	defer cancel()
+
+	if index != nil {
+		has, err := index.hasEntries(ctx, caller)
+		if err != nil {
+			logf(ctx, "check for entries failed: %v", err)
+			return false
+		}
+		return !has
+	}
+	if !cfg.ownsNotionTarget(caller) || !cfg.usesStore("notion") {
+		return false
+	}
+	target := cfg.notionTarget(caller)
+	_, _, err := latestEntry(ctx, cfg, cfg.notionClient(target.Token), target)
+	if err != nil && err != errNoEntries {
+		logf(ctx, "check for entries failed: %v", err)
+	}
+	return err == errNoEntries
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How human-readable dates and times, and the text around them, are written
+// in page bodies and titles. Notion's Date property is always ISO.
+type locale struct {
+	weekdays [7]string
+	months   [12]string
+	// Formats taking the weekday, day of the month, month, year, and time, in
+	// that order
+	dateTimeFormat string
+	dayFormat      string
+	// Whether times use a 12-hour clock with AM and PM
+	twelveHour bool
+
+	recorded  string
+	by        string
+	call      string
+	continued string
+	// Labels the original transcript under a translation, taking its
+	// language code
+	original string
+}
+
+var locales = map[string]locale{
+	"en": {
+		weekdays:       [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		months:         [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		dateTimeFormat: "%[1]s, %[3]s %[2]d, %[4]d at %[5]s",
+		dayFormat:      "%[1]s, %[3]s %[2]d",
+		twelveHour:     true,
+		recorded:       "Recorded %s",
+		by:             " by %s",
+		call:           ", call ",
+		continued:      "Continued at %s",
+		original:       "Original (%s)",
+	},
+	"es": {
+		weekdays:       [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		months:         [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		dateTimeFormat: "%[1]s, %[2]d de %[3]s de %[4]d a las %[5]s",
+		dayFormat:      "%[1]s, %[2]d de %[3]s",
+		recorded:       "Grabado el %s",
+		by:             " por %s",
+		call:           ", llamada ",
+		continued:      "Continuación a las %s",
+		original:       "Original (%s)",
+	},
+	"fr": {
+		weekdays:       [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		months:         [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		dateTimeFormat: "%[1]s %[2]d %[3]s %[4]d à %[5]s",
+		dayFormat:      "%[1]s %[2]d %[3]s",
+		recorded:       "Enregistré le %s",
+		by:             " par %s",
+		call:           ", appel ",
+		continued:      "Suite à %s",
+		original:       "Original (%s)",
+	},
+	"de": {
+		weekdays:       [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		months:         [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		dateTimeFormat: "%[1]s, %[2]d. %[3]s %[4]d um %[5]s",
+		dayFormat:      "%[1]s, %[2]d. %[3]s",
+		recorded:       "Aufgenommen am %s",
+		by:             " von %s",
+		call:           ", Anruf ",
+		continued:      "Fortgesetzt um %s",
+		original:       "Original (%s)",
+	},
+	"pt": {
+		weekdays:       [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		months:         [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		dateTimeFormat: "%[1]s, %[2]d de %[3]s de %[4]d às %[5]s",
+		dayFormat:      "%[1]s, %[2]d de %[3]s",
+		recorded:       "Gravado em %s",
+		by:             " por %s",
+		call:           ", chamada ",
+		continued:      "Continuação às %s",
+		original:       "Original (%s)",
+	},
+	"it": {
+		weekdays:       [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		months:         [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		dateTimeFormat: "%[1]s %[2]d %[3]s %[4]d alle %[5]s",
+		dayFormat:      "%[1]s %[2]d %[3]s",
+		recorded:       "Registrato il %s",
+		by:             " da %s",
+		call:           ", chiamata ",
+		continued:      "Continuato alle %s",
+		original:       "Originale (%s)",
+	},
+}
+
+// Accepts a language code, optionally with a region that's ignored, like
+// "es" or "es-MX"
+func (l *locale) UnmarshalText(text []byte) error {
+	code := strings.ToLower(string(text))
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	loaded, ok := locales[code]
+	if !ok {
+		return fmt.Errorf("unsupported locale: %q", text)
+	}
+	*l = loaded
+	return nil
+}
+
+// e.g. "3:04 PM" or "15:04"
+func (l locale) time(t time.Time) string {
+	if l.twelveHour {
+		return t.Format("3:04 PM")
+	}
+	return t.Format("15:04")
+}
+
+// e.g. "Monday, January 2, 2006 at 3:04 PM"
+func (l locale) dateTime(t time.Time) string {
+	return fmt.Sprintf(l.dateTimeFormat, l.weekdays[t.Weekday()], t.Day(), l.months[t.Month()-1], t.Year(), l.time(t))
+}
+
+// e.g. "Monday, January 2"
+func (l locale) day(t time.Time) string {
+	return fmt.Sprintf(l.dayFormat, l.weekdays[t.Weekday()], t.Day(), l.months[t.Month()-1])
+}
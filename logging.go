@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	callSidKey
+)
+
+// Serializes writes so that concurrent log lines don't interleave
+var logMu sync.Mutex
+
+func writeLogLine(fields map[string]interface{}) {
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"msg":%q}`, err.Error()))
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stdout.Write(append(line, '\n'))
+}
+
+// Logs a message as JSON, tagged with the request ID in ctx if there is one
+func logf(ctx context.Context, format string, args ...interface{}) {
+	fields := map[string]interface{}{
+		"msg": fmt.Sprintf(format, args...),
+	}
+	if id := requestId(ctx); id != "" {
+		fields["request_id"] = id
+	}
+	if callSid, _ := ctx.Value(callSidKey).(string); callSid != "" {
+		fields["call_sid"] = callSid
+	}
+	writeLogLine(fields)
+}
+
+// Tags log lines for ctx with the call's SID, so that a recording's pipeline
+// can be matched up with the /call request that started it
+func withCallSid(ctx context.Context, callSid string) context.Context {
+	return context.WithValue(ctx, callSidKey, callSid)
+}
+
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// Returns a context that carries the request's ID but isn't canceled when the
+// request finishes, for work that outlives the request
+func detachedContext(c *gin.Context) context.Context {
+	return context.WithValue(context.Background(), requestIdKey, requestId(c.Request.Context()))
+}
+
+func newRequestId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Assigns each request an ID and logs it as a JSON line once it's handled
+func accessLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader("X-Request-Id")
+		if id == "" {
+			id = newRequestId()
+		}
+		c.Header("X-Request-Id", id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIdKey, id))
+
+		c.Next()
+
+		fields := map[string]interface{}{
+			"request_id": id,
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+		}
+		// Only populated for Twilio callbacks, once the form has been parsed
+		if caller := c.Request.PostForm.Get("From"); caller != "" {
+			fields["caller"] = caller
+		}
+		if callSid := c.Request.PostForm.Get("CallSid"); callSid != "" {
+			fields["call_sid"] = callSid
+		}
+		if len(c.Errors) > 0 {
+			fields["errors"] = c.Errors.String()
+		}
+		writeLogLine(fields)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dstotijn/go-notion"
+)
+
+// Returns the plain text of a block's paragraphs, quotes, callouts, and
+// toggles, including any nested under them, one block per line
+func blockText(ctx context.Context, notionClient *notion.Client, blockId string) (string, error) {
+	var sb strings.Builder
+	query := &notion.PaginationQuery{}
+	for {
+		result, err := notionClient.FindBlockChildrenByID(ctx, blockId, query)
+		if err != nil {
+			return "", err
+		}
+		for _, block := range result.Results {
+			var richText []notion.RichText
+			switch b := block.(type) {
+			case *notion.ParagraphBlock:
+				richText = b.RichText
+			case *notion.QuoteBlock:
+				richText = b.RichText
+			case *notion.CalloutBlock:
+				richText = b.RichText
+			case *notion.ToggleBlock:
+				richText = b.RichText
+			default:
+				continue
+			}
+			for _, text := range richText {
+				sb.WriteString(text.PlainText)
+			}
+			sb.WriteString("\n")
+			if block.HasChildren() {
+				children, err := blockText(ctx, notionClient, block.ID())
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString(children)
+			}
+		}
+		if !result.HasMore || result.NextCursor == nil {
+			return sb.String(), nil
+		}
+		query.StartCursor = *result.NextCursor
+	}
+}
+
+// Returns the part of the transcript that isn't already on the page: nothing
+// if the page already contains all of it, as it does when a callback is
+// redelivered, or the rest of it if the page ends with its first few words
+func unsavedTranscript(existing, transcript string) string {
+	existingWords := strings.Fields(existing)
+	words := strings.Fields(transcript)
+	if len(words) == 0 || containsWords(existingWords, words) {
+		return ""
+	}
+	if n := segmentOverlap(existingWords, words); n > 0 {
+		return capitalizeFirst(strings.Join(words[n:], " "))
+	}
+	return transcript
+}
+
+// Reports whether needle appears in haystack as a run of words, ignoring case
+// and punctuation
+func containsWords(haystack, needle []string) bool {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if equalWords(haystack[i:i+len(needle)], needle) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	whispercpp "github.com/ggerganov/whisper.cpp/bindings/go"
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/pkg/errors"
+)
+
+// Guards the whisper models so that they can be swapped out at runtime. Every
+// context created from a model shares the same underlying whisper state, so a
+// model only transcribes one recording at a time. To transcribe several at
+// once, the holder keeps a pool of instances of the same model, each loaded
+// separately, and transcriptions wait for a free one. A reload waits for each
+// instance's in-flight transcription to finish before closing it.
+//
+// The holder starts out empty so that the server can come up while the first
+// model loads, which can take a while for the larger models.
+type modelHolder struct {
+	// Instances not in use. Each one is taken off for exclusive use and put
+	// back after, so this is also the queue of waiting transcriptions.
+	free      chan *modelInstance
+	instances int
+	// Held while taking more than one instance, since two callers each
+	// holding some of them would wait on each other forever
+	drainMu sync.Mutex
+
+	// Guards the description of the loaded model
+	mu           sync.Mutex
+	file         string
+	multilingual bool
+	languages    int
+
+	// Closed once the first model is loaded
+	loaded     chan struct{}
+	loadedOnce sync.Once
+}
+
+// One loaded copy of the model, nil until the first load
+type modelInstance struct {
+	model whisper.Model
+}
+
+var errModelNotReady = errors.New("model not loaded yet")
+
+// Returns a holder for the given number of model instances, at least one
+func newModelHolder(instances int) *modelHolder {
+	if instances < 1 {
+		instances = 1
+	}
+	h := &modelHolder{
+		free:      make(chan *modelInstance, instances),
+		instances: instances,
+		loaded:    make(chan struct{}),
+	}
+	for i := 0; i < instances; i++ {
+		h.free <- &modelInstance{}
+	}
+	return h
+}
+
+// Reports whether a model has been loaded
+func (h *modelHolder) ready() bool {
+	select {
+	case <-h.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// Blocks until a model has been loaded or ctx is done
+func (h *modelHolder) wait(ctx context.Context) error {
+	select {
+	case <-h.loaded:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stops waiting for a model to load, for when the first one failed and
+// another transcriber can stand in. Transcriptions fail with errModelNotReady
+// until a model is reloaded.
+func (h *modelHolder) giveUp() {
+	h.loadedOnce.Do(func() { close(h.loaded) })
+}
+
+// Runs fn with exclusive use of a model instance, waiting for one to be free,
+// and of up to max-1 more that are free right away, for transcribing a
+// recording's chunks at once. Only the first is waited for, so a transcription
+// never holds instances while waiting on another for more. Returns
+// errModelNotReady if no model has been loaded yet.
+func (h *modelHolder) use(max int, fn func([]whisper.Model) error) error {
+	instances := []*modelInstance{<-h.free}
+	defer func() {
+		for _, instance := range instances {
+			h.free <- instance
+		}
+	}()
+more:
+	for len(instances) < max {
+		select {
+		case instance := <-h.free:
+			instances = append(instances, instance)
+		default:
+			break more
+		}
+	}
+
+	// A failed first load can leave some instances without a model
+	models := make([]whisper.Model, 0, len(instances))
+	for _, instance := range instances {
+		if instance.model != nil {
+			models = append(models, instance.model)
+		}
+	}
+	if len(models) == 0 {
+		return errModelNotReady
+	}
+	return fn(models)
+}
+
+// Loads the model in file into every instance, swapping each one in for the
+// current model, if any, as soon as it's free. Instances are loaded one at a
+// time, so memory only has to fit one model more than the pool. If a load
+// fails, instances that were already swapped keep the new model, and the rest
+// keep the old one.
+func (h *modelHolder) reload(file string) error {
+	h.drainMu.Lock()
+	defer h.drainMu.Unlock()
+	for i := 0; i < h.instances; i++ {
+		model, err := whisper.New(file)
+		if err != nil {
+			return errors.Wrap(err, "create whisper model failed")
+		}
+
+		// Every instance is either free or in use, and ones already
+		// swapped are kept aside until the rest are done
+		instance := <-h.free
+		defer func() { h.free <- instance }()
+		old := instance.model
+		instance.model = model
+
+		h.mu.Lock()
+		h.file = file
+		h.multilingual = model.IsMultilingual()
+		h.languages = len(model.Languages())
+		h.mu.Unlock()
+		h.loadedOnce.Do(func() { close(h.loaded) })
+
+		if old != nil {
+			if err := old.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *modelHolder) Close() error {
+	h.drainMu.Lock()
+	defer h.drainMu.Unlock()
+	var err error
+	for i := 0; i < h.instances; i++ {
+		instance := <-h.free
+		if instance.model != nil {
+			if closeErr := instance.model.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// Runs a second of silence through every instance, so that the first real
+// transcriptions don't pay for warming them up
+func (h *modelHolder) warmUp() error {
+	defer timer(context.Background(), "warm up model")()
+	h.drainMu.Lock()
+	defer h.drainMu.Unlock()
+
+	// Taking them all at once is the only way to be sure each one is warmed
+	instances := make([]*modelInstance, h.instances)
+	for i := range instances {
+		instances[i] = <-h.free
+	}
+	defer func() {
+		for _, instance := range instances {
+			h.free <- instance
+		}
+	}()
+	for _, instance := range instances {
+		if instance.model == nil {
+			return errModelNotReady
+		}
+		context, err := instance.model.NewContext()
+		if err != nil {
+			return err
+		}
+		if err := context.Process(make([]float32, whisper.SampleRate), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describes the current model's language support
+func (h *modelHolder) info() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == "" {
+		return "not loaded"
+	}
+	instances := ""
+	if h.instances > 1 {
+		instances = fmt.Sprintf(", %d instances", h.instances)
+	}
+	if !h.multilingual {
+		return fmt.Sprintf("%s: english-only%s", h.file, instances)
+	}
+	return fmt.Sprintf("%s: multilingual, %d languages%s", h.file, h.languages, instances)
+}
+
+// Describes what whisper.cpp was built to compute with, which is only logged.
+// Acceleration is chosen when the library is compiled, not at runtime, and
+// the version the bindings are pinned to only has CPU code paths, optionally
+// with BLAS for the encoder, so there's no CUDA or Metal to configure.
+func computeBackend() string {
+	info := strings.TrimSpace(whispercpp.Whisper_print_system_info())
+	backend := "CPU"
+	if strings.Contains(info, "BLAS = 1") {
+		backend = "CPU with BLAS"
+	}
+	if info == "" {
+		return backend
+	}
+	return fmt.Sprintf("%s (%s)", backend, strings.TrimSuffix(info, " |"))
+}
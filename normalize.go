@@ -0,0 +1,42 @@
+package main
+
+const (
+	// Peak level that normalized audio is scaled to, leaving some headroom
+	// below full scale
+	normalizePeak = 0.9
+	// Largest gain applied when normalizing, so that a silent recording's
+	// noise floor isn't blown up into something whisper tries to transcribe
+	maxNormalizeGain = 20
+)
+
+func peakLevel(samples []float32) float32 {
+	var peak float32
+	for _, sample := range samples {
+		if sample < 0 {
+			sample = -sample
+		}
+		if sample > peak {
+			peak = sample
+		}
+	}
+	return peak
+}
+
+// Returns the gain that brings audio with the given peak up to normalizePeak.
+// Since the gain is derived from the peak, nothing is pushed past full scale.
+func normalizeGain(peak float32) float32 {
+	if peak == 0 {
+		return 1
+	}
+	gain := normalizePeak / peak
+	if gain > maxNormalizeGain {
+		gain = maxNormalizeGain
+	}
+	return gain
+}
+
+func applyGain(samples []float32, gain float32) {
+	for i := range samples {
+		samples[i] *= gain
+	}
+}
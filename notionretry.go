@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dstotijn/go-notion"
+)
+
+// Wait before retrying a rate-limited request that didn't say how long to wait
+const defaultRetryAfter = time.Second
+
+// Number of Notion requests that were rate limited, for /metrics
+var notionRateLimited atomic.Int64
+
+// Notion clients by token. Clients are safe for concurrent use, so each is
+// built once and shared by every request made with its token.
+var notionClients sync.Map
+
+// Returns the Notion client for the token, which retries rate-limited
+// requests
+func (cfg config) notionClient(token string) *notion.Client {
+	if client, ok := notionClients.Load(token); ok {
+		return client.(*notion.Client)
+	}
+	transport := &rateLimitTransport{
+		next:       cfg.httpTransport(),
+		maxRetries: cfg.NotionMaxRetries,
+		maxWait:    cfg.NotionMaxRetryWait,
+	}
+	client := notion.NewClient(token, notion.WithHTTPClient(&http.Client{Transport: transport}))
+	// Another request may have built one first, in which case theirs wins
+	shared, _ := notionClients.LoadOrStore(token, client)
+	return shared.(*notion.Client)
+}
+
+// Retries requests that Notion answers with 429, waiting exactly as long as
+// its Retry-After header says rather than guessing
+type rateLimitTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	// Longest wait that's worth it. A longer Retry-After gives up instead,
+	// leaving the entry for the failed store.
+	maxWait time.Duration
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := t.next.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+		notionRateLimited.Add(1)
+
+		wait := retryAfter(res.Header.Get("Retry-After"))
+		ctx := req.Context()
+		if attempt >= t.maxRetries || wait > t.maxWait || req.Body != nil && req.GetBody == nil {
+			logf(ctx, "Notion rate limited %s %s, retry after %v, giving up", req.Method, req.URL.Path, wait)
+			return res, nil
+		}
+		logf(ctx, "Notion rate limited %s %s, retrying after %v", req.Method, req.URL.Path, wait)
+		res.Body.Close()
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// Parses a Retry-After header given in seconds, which is what Notion sends
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds < 0 {
+		return defaultRetryAfter
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
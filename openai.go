@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/pkg/errors"
+)
+
+// Largest file OpenAI's transcription API accepts, about 13 minutes of 16kHz
+// mono audio
+const openAIMaxBytes = 25 << 20
+
+// Transcribes with OpenAI's hosted whisper, for servers too small to run a
+// model of their own
+type openAITranscriber struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+type openAIResponse struct {
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	Segments []struct {
+		Start      float64 `json:"start"`
+		End        float64 `json:"end"`
+		Text       string  `json:"text"`
+		AvgLogprob float64 `json:"avg_logprob"`
+	} `json:"segments"`
+}
+
+// Only the language, prompt, and vocabulary are passed on. Normalization,
+// chunking, and thread options are specific to the local model.
+func (t openAITranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "openai transcription")()
+
+	if recording.Size() > openAIMaxBytes {
+		return transcriptResult{}, fmt.Errorf("recording too large for openai: %d bytes", recording.Size())
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, err := form.CreateFormFile("file", "recording.wav")
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	if _, err := io.Copy(file, io.NewSectionReader(recording, 0, recording.Size())); err != nil {
+		return transcriptResult{}, err
+	}
+	form.WriteField("model", t.model)
+	// The verbose format includes segments, which confidence is taken from
+	form.WriteField("response_format", "verbose_json")
+	if opts.Language != "" {
+		form.WriteField("language", opts.Language)
+	}
+	// The prompt is the only way to tell whisper about names
+	if prompt := strings.TrimSpace(opts.Prompt + " " + strings.Join(opts.Vocabulary, ", ")); prompt != "" {
+		form.WriteField("prompt", prompt)
+	}
+	if err := form.Close(); err != nil {
+		return transcriptResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, body)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return transcriptResult{}, fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, message)
+	}
+	var parsed openAIResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return transcriptResult{}, errors.Wrap(err, "parse openai response failed")
+	}
+
+	// Confidence is the average probability of each segment's tokens, as
+	// near as the log probabilities OpenAI reports allow
+	var confidence float64
+	var segments []timedSegment
+	for _, segment := range parsed.Segments {
+		confidence += math.Exp(segment.AvgLogprob) / float64(len(parsed.Segments))
+		s := whisper.Segment{
+			Start: time.Duration(segment.Start * float64(time.Second)),
+			End:   time.Duration(segment.End * float64(time.Second)),
+			Text:  segment.Text,
+		}
+		segments = append(segments, newTimedSegment(s))
+		if opts.OnSegment != nil {
+			opts.OnSegment(s)
+		}
+	}
+	if len(parsed.Segments) == 0 {
+		confidence = 1
+	}
+	// The verbose format names the language in full rather than giving its
+	// code, as every other transcriber does
+	language := opts.Language
+	if language == "" {
+		language = languageCode(parsed.Language)
+	}
+	return transcriptResult{Text: strings.TrimSpace(parsed.Text), Confidence: confidence, Language: language, Segments: segments}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAITranscriberLanguageCode(t *testing.T) {
+	tests := []struct {
+		reported string
+		given    string
+		want     string
+	}{
+		{"english", "", "en"},
+		{"Spanish", "", "es"},
+		{"haitian creole", "", "ht"},
+		{"en", "", "en"},
+		{"klingon", "", "klingon"},
+		{"english", "fr", "fr"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"text": "Hello.", "language": %q, "segments": []}`, test.reported)
+		}))
+		transcriber := openAITranscriber{url: server.URL, client: server.Client()}
+		result, err := transcriber.Transcribe(context.Background(), testWav(t, 16000, 1, 1), transcribeOptions{Language: test.given})
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Language != test.want {
+			t.Errorf("reported %q with %q given: language = %q, want %q", test.reported, test.given, result.Language, test.want)
+		}
+	}
+}
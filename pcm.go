@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/go-audio/audio"
+	gwav "github.com/go-audio/wav"
+)
+
+// Reads the samples of a mono WAV file as floats in fixed-size chunks, so that
+// only a chunk of a long recording is held in memory at a time. The buffers
+// are reused between chunks.
+type pcmReader struct {
+	dec    *gwav.Decoder
+	ints   *audio.IntBuffer
+	floats []float32
+	// Full scale for the file's bit depth, which samples are divided by
+	scale float32
+}
+
+func newPCMReader(recording io.ReadSeeker, chunkSamples int) (*pcmReader, error) {
+	dec := gwav.NewDecoder(recording)
+	if err := dec.FwdToPCM(); err != nil {
+		return nil, err
+	}
+	if dec.NumChans != whisperNumChans {
+		return nil, fmt.Errorf("unsupported number of channels: %d", dec.NumChans)
+	}
+	return &pcmReader{
+		dec:    dec,
+		ints:   &audio.IntBuffer{Data: make([]int, chunkSamples)},
+		floats: make([]float32, chunkSamples),
+		scale:  float32(math.Pow(2, float64(dec.BitDepth)-1)),
+	}, nil
+}
+
+// Returns the next chunk of samples, normalized to [-1, 1], or io.EOF once
+// there are none left. The chunk is only valid until the next call.
+func (r *pcmReader) next() ([]float32, error) {
+	n, err := r.dec.PCMBuffer(r.ints)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	for i, sample := range r.ints.Data[:n] {
+		r.floats[i] = float32(sample) / r.scale
+	}
+	return r.floats[:n], nil
+}
+
+// Returns the peak level of a WAV file, reading it a chunk at a time and
+// leaving the reader at the start of the file
+func wavPeak(recording io.ReadSeeker, chunkSamples int) (float32, error) {
+	pcm, err := newPCMReader(recording, chunkSamples)
+	if err != nil {
+		return 0, err
+	}
+	var peak float32
+	for {
+		samples, err := pcm.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if chunkPeak := peakLevel(samples); chunkPeak > peak {
+			peak = chunkPeak
+		}
+	}
+	_, err = recording.Seek(0, io.SeekStart)
+	return peak, err
+}
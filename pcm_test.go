@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+	bwav "github.com/faiface/beep/wav"
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	ws "github.com/orcaman/writerseeker"
+)
+
+// Stands in for a whisper model, producing one segment per chunk and
+// recording the size of each chunk it's given
+type fakeModel struct {
+	chunks []int
+	// If set, gives each chunk's text rather than numbering them
+	text func(data []float32) string
+	// How long each chunk takes
+	delay time.Duration
+	// If set, whether processing the chunk fails
+	fail func(data []float32) bool
+	// If set, the most memory in use while any chunk was processed
+	measureHeap bool
+	peakHeap    uint64
+}
+
+func (m *fakeModel) Close() error         { return nil }
+func (m *fakeModel) IsMultilingual() bool { return false }
+func (m *fakeModel) Languages() []string  { return []string{"en"} }
+
+func (m *fakeModel) NewContext() (whisper.Context, error) {
+	return &fakeContext{model: m}, nil
+}
+
+// Only implements what transcribeChunk calls, the rest panic
+type fakeContext struct {
+	whisper.Context
+	model    *fakeModel
+	segments []whisper.Segment
+}
+
+func (c *fakeContext) IsMultilingual() bool        { return false }
+func (c *fakeContext) Language() string            { return "en" }
+func (c *fakeContext) SetTranslate(bool)           {}
+func (c *fakeContext) SetThreads(uint)             {}
+func (c *fakeContext) SetMaxTokensPerSegment(uint) {}
+func (c *fakeContext) SetSpeedup(bool)             {}
+func (c *fakeContext) IsText(whisper.Token) bool   { return true }
+
+func (c *fakeContext) Process(data []float32, cb whisper.SegmentCallback) error {
+	c.model.chunks = append(c.model.chunks, len(data))
+	if c.model.measureHeap {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > c.model.peakHeap {
+			c.model.peakHeap = stats.HeapAlloc
+		}
+	}
+	time.Sleep(c.model.delay)
+	if c.model.fail != nil && c.model.fail(data) {
+		return errors.New("process failed")
+	}
+	text := fmt.Sprintf(" chunk %d", len(c.model.chunks))
+	if c.model.text != nil {
+		text = c.model.text(data)
+	}
+	c.segments = []whisper.Segment{{
+		Text:   text,
+		End:    time.Duration(len(data)) * time.Second / whisper.SampleRate,
+		Tokens: []whisper.Token{{P: 0.5}},
+	}}
+	if cb != nil {
+		for _, segment := range c.segments {
+			cb(segment)
+		}
+	}
+	return nil
+}
+
+func (c *fakeContext) NextSegment() (whisper.Segment, error) {
+	if len(c.segments) == 0 {
+		return whisper.Segment{}, io.EOF
+	}
+	segment := c.segments[0]
+	c.segments = c.segments[1:]
+	return segment, nil
+}
+
+func TestPCMReaderChunks(t *testing.T) {
+	pcm, err := newPCMReader(testWav(t, whisper.SampleRate, 1, 1), 6000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	var first *float32
+	for {
+		samples, err := pcm.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(samples))
+		if first == nil {
+			first = &samples[0]
+		} else if &samples[0] != first {
+			t.Error("chunk wasn't read into the reused buffer")
+		}
+		for _, sample := range samples {
+			if sample < -1 || sample > 1 {
+				t.Fatalf("sample %v outside [-1, 1]", sample)
+			}
+		}
+	}
+	if fmt.Sprint(sizes) != "[6000 6000 4000]" {
+		t.Errorf("chunk sizes = %v, want [6000 6000 4000]", sizes)
+	}
+}
+
+func TestTranscribeRecordingChunks(t *testing.T) {
+	model := &fakeModel{}
+	// Three seconds of audio in two second chunks
+	recording := testWav(t, whisper.SampleRate, 1, 3)
+	result, err := transcribeRecording(context.Background(), []whisper.Model{model}, recording, transcribeOptions{ChunkSeconds: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(model.chunks) != fmt.Sprint([]int{2 * whisper.SampleRate, whisper.SampleRate}) {
+		t.Errorf("chunk sizes = %v, want [%d %d]", model.chunks, 2*whisper.SampleRate, whisper.SampleRate)
+	}
+	if result.Text != " chunk 1 chunk 2" {
+		t.Errorf("transcript = %q, want %q", result.Text, " chunk 1 chunk 2")
+	}
+	// Each chunk's segments are offset by the chunks before it
+	if len(result.Segments) != 2 || result.Segments[1].Start != 2 || result.Segments[1].End != 3 {
+		t.Errorf("segments = %+v, want the second from 2s to 3s", result.Segments)
+	}
+}
+
+// Encodes a 16kHz mono WAV holding each level for a second
+func levelsWav(t *testing.T, levels ...float64) *bytes.Reader {
+	t.Helper()
+	var i int
+	steps := beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		n := 0
+		for ; n < len(samples) && i < len(levels)*whisper.SampleRate; n++ {
+			level := levels[i/whisper.SampleRate]
+			samples[n] = [2]float64{level, level}
+			i++
+		}
+		return n, n > 0
+	})
+	w := ws.WriterSeeker{}
+	if err := bwav.Encode(&w, steps, beep.Format{SampleRate: whisper.SampleRate, NumChannels: 1, Precision: 2}); err != nil {
+		t.Fatal(err)
+	}
+	return w.BytesReader()
+}
+
+// Chunks spread across model instances come back in recording order
+func TestTranscribeRecordingConcurrently(t *testing.T) {
+	level := func(data []float32) string { return fmt.Sprintf(" %.1f", data[0]) }
+	models := []*fakeModel{
+		{text: level, delay: 10 * time.Millisecond},
+		{text: level, delay: 10 * time.Millisecond},
+	}
+	recording := levelsWav(t, 0.1, 0.2, 0.3, 0.4, 0.5)
+
+	var mu sync.Mutex
+	var streamed []string
+	opts := transcribeOptions{ChunkSeconds: 1, OnSegment: func(segment whisper.Segment) {
+		mu.Lock()
+		defer mu.Unlock()
+		streamed = append(streamed, segment.Text)
+	}}
+	result, err := transcribeRecording(context.Background(), []whisper.Model{models[0], models[1]}, recording, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = " 0.1 0.2 0.3 0.4 0.5"
+	if result.Text != want {
+		t.Errorf("transcript = %q, want %q", result.Text, want)
+	}
+	if got := strings.Join(streamed, ""); got != want {
+		t.Errorf("streamed segments %q, want %q", got, want)
+	}
+	for i, segment := range result.Segments {
+		if segment.Start != float64(i) || segment.End != float64(i+1) {
+			t.Errorf("segment %d from %vs to %vs, want %ds to %ds", i, segment.Start, segment.End, i, i+1)
+		}
+	}
+	if len(models[0].chunks) == 0 || len(models[1].chunks) == 0 {
+		t.Errorf("instances transcribed %d and %d chunks, want both used", len(models[0].chunks), len(models[1].chunks))
+	}
+}
+
+// Nothing after a failed chunk is streamed, and the recording fails
+func TestTranscribeRecordingConcurrentlyFails(t *testing.T) {
+	level := func(data []float32) string { return fmt.Sprintf(" %.1f", data[0]) }
+	third := func(data []float32) bool { return level(data) == " 0.3" }
+	models := []whisper.Model{
+		&fakeModel{text: level, fail: third, delay: 10 * time.Millisecond},
+		&fakeModel{text: level, fail: third, delay: 10 * time.Millisecond},
+	}
+	recording := levelsWav(t, 0.1, 0.2, 0.3, 0.4, 0.5)
+
+	var mu sync.Mutex
+	var streamed []string
+	opts := transcribeOptions{ChunkSeconds: 1, OnSegment: func(segment whisper.Segment) {
+		mu.Lock()
+		defer mu.Unlock()
+		streamed = append(streamed, segment.Text)
+	}}
+	if _, err := transcribeRecording(context.Background(), models, recording, opts); err == nil {
+		t.Error("transcribeRecording() = nil, want the chunk's error")
+	}
+	if got := strings.Join(streamed, ""); got != " 0.1 0.2" {
+		t.Errorf("streamed segments %q, want %q", got, " 0.1 0.2")
+	}
+}
+
+// Memory in use shouldn't grow with the length of the recording, since only
+// a chunk is decoded at a time
+func TestTranscribeRecordingBoundedMemory(t *testing.T) {
+	inUse := func(seconds int) uint64 {
+		recording := testWav(t, whisper.SampleRate, 1, seconds)
+		model := &fakeModel{measureHeap: true}
+		var before runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		if _, err := transcribeRecording(context.Background(), []whisper.Model{model}, recording, transcribeOptions{ChunkSeconds: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if model.peakHeap < before.HeapAlloc {
+			return 0
+		}
+		return model.peakHeap - before.HeapAlloc
+	}
+	short, long := inUse(5), inUse(60)
+	// Decoding the whole of the longer recording at once would hold 55
+	// seconds more of float32 samples
+	whole := uint64(55 * whisper.SampleRate * 4)
+	if long > short && long-short > whole/10 {
+		t.Errorf("transcribing 60s held %d bytes more than 5s, want well under %d", long-short, whole)
+	}
+}
+
+func BenchmarkTranscribeRecording(b *testing.B) {
+	recording := testWav(b, whisper.SampleRate, 1, 60)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := recording.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := transcribeRecording(context.Background(), []whisper.Model{&fakeModel{}}, recording, transcribeOptions{ChunkSeconds: 1}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/pkg/errors"
+)
+
+// Name of the pipeline stage that saves entries. Failures at this stage keep
+// the entry so that retrying only has to save it again.
+const saveStage = "save entry"
+
+// Name of the pipeline stage that waits for the model to load. Recordings
+// that fail here are retried automatically once it has.
+const modelStage = "wait for model"
+
+// Returned by a pipeline step to stop processing a recording that shouldn't
+// become an entry
+var errSkipRecording = errors.New("skip recording")
+
+// Everything the recording pipeline depends on, shared by every recording
+type pipeline struct {
+	cfg         config
+	models      *modelHolder
+	transcriber Transcriber
+	archiver    *archiver
+	store       TranscriptStore
+	index       *sqliteStore
+	failed      *failedStore
+	raw         *rawAudioStore
+	// Held while a recording is kept to wait for the model, and while
+	// those are queued for retry once it loads, so that none is kept
+	// after the retries are queued
+	waitingMu sync.Mutex
+}
+
+type pipelineStep struct {
+	name string
+	run  func() error
+}
+
+// Name the failed store gives recordings whose pipeline panicked, which are
+// retried from the start
+const panicStage = "panic"
+
+// Turns a recording into entries, keeping it in the failed store if any stage
+// fails so that it can be retried
+func (p *pipeline) processRecording(ctx context.Context, rec recording) {
+	stats.processed.Add(1)
+	// A malformed recording that crashes a decoder mustn't take the worker
+	// down with it, or lose the recording
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("pipeline panicked: %v", r)
+			logf(ctx, "%v processing %s\n%s", err, rec.Sid, debug.Stack())
+			p.saveFailed(ctx, failedEntry{Id: rec.Sid, Recording: rec, Stage: panicStage, Error: err.Error()})
+		}
+	}()
+	_, stage, err := p.run(ctx, rec)
+	if stage == modelStage && err == errModelNotReady {
+		if p.keepWaiting(ctx, rec) {
+			return
+		}
+		// The model loaded since the recording found it wasn't
+		_, stage, err = p.run(ctx, rec)
+	}
+	if _, ok := err.(unsavedError); ok {
+		// Each entry that failed to save is in the failed store already
+		return
+	} else if err != nil {
+		logf(ctx, "%v", err)
+		p.saveFailed(ctx, failedEntry{Id: rec.Sid, Recording: rec, Stage: stage, Error: err.Error()})
+	}
+}
+
+// Runs each step of the pipeline in turn, stopping at the first that fails.
+// Returns the transcript, or the name of the failed step along with its error.
+func (p *pipeline) run(ctx context.Context, rec recording) (transcript, stage string, err error) {
+	cfg := p.cfg
+	var recording *bytes.Reader
+	// One recording per speaker when speakers are separated, otherwise just
+	// the one
+	var prepared []*bytes.Reader
+	var confidence float64
+	var truncated bool
+	var language string
+	var segments []timedSegment
+	// Only set when the transcript was translated
+	var original string
+	var saveErr error
+
+	// Steps that turn the recording's audio into a transcript
+	audioSteps := []pipelineStep{
+		{modelStage, func() error {
+			// Recordings that arrive while the model loads are kept in
+			// the failed store until it's ready, or wait for it if there
+			// isn't one
+			if p.models == nil || p.models.ready() {
+				return nil
+			} else if p.failed != nil {
+				return errModelNotReady
+			}
+			logf(ctx, "Waiting for model to load")
+			return p.models.wait(ctx)
+		}},
+		{"download recording", func() (err error) {
+			if p.raw != nil {
+				// A retry can use the copy saved when it was first
+				// downloaded, which outlasts Twilio's
+				if recording, err = p.raw.load(rec.Sid); err != nil {
+					logf(ctx, "load saved audio failed: %v", err)
+				} else if recording != nil {
+					logf(ctx, "Using saved audio for recording %s", rec.Sid)
+					return nil
+				}
+			}
+			recording, err = downloadRecording(ctx, cfg, rec)
+			if err != nil {
+				return err
+			}
+			if p.raw != nil {
+				if err := p.raw.save(rec.Sid, recording); err != nil {
+					logf(ctx, "save raw audio failed: %v", err)
+				}
+			}
+			if p.archiver != nil {
+				p.archive(ctx, rec, recording)
+			}
+			return nil
+		}},
+		{"prepare recording", func() (err error) {
+			if cfg.SpeakerSeparation && rec.Channels == len(speakerLabels) {
+				prepared, err = prepareChannels(ctx, cfg, recording, rec.Channels)
+			} else {
+				var resampled *bytes.Reader
+				resampled, err = prepareRecording(ctx, cfg, recording)
+				prepared = []*bytes.Reader{resampled}
+			}
+			if err == nil && cfg.DebugAudioDir != "" {
+				// Only an aid to debugging, so it never stops a recording
+				err := saveDebugAudio(cfg.DebugAudioDir, cfg.DebugAudioMaxBytes, rec.Sid, prepared)
+				if err != nil {
+					logf(ctx, "save debug audio failed: %v", err)
+				}
+			}
+			return err
+		}},
+		{"measure recording", func() error {
+			// Twilio usually reports the duration, in which case short
+			// recordings never make it this far
+			if rec.Duration != 0 || cfg.MinRecordingSeconds == 0 {
+				return nil
+			}
+			duration, err := wavDuration(prepared[0])
+			if err != nil {
+				return err
+			}
+			if duration.Seconds() < cfg.MinRecordingSeconds {
+				logf(ctx, "Skipping recording shorter than minimum: %s (%v)", rec.Sid, duration)
+				return errSkipRecording
+			}
+			return nil
+		}},
+		{"transcribe recording", func() error {
+			opts := cfg.transcribeOptions(rec.Caller)
+			// Diarization needs the segments' timings, which are
+			// collected as they're transcribed
+			var heard []whisper.Segment
+			diarize := cfg.DiarizationUrl != "" && len(prepared) == 1
+			if diarize {
+				onSegment := opts.OnSegment
+				opts.OnSegment = func(segment whisper.Segment) {
+					heard = append(heard, segment)
+					if onSegment != nil {
+						onSegment(segment)
+					}
+				}
+			}
+			var texts, originals []string
+			translated := false
+			for i, r := range prepared {
+				stopTimer := timer(ctx, transcriptionTimer)
+				result, err := p.transcriber.Transcribe(ctx, r, opts)
+				stopTimer()
+				text := result.Text
+				if diarize && err == nil {
+					text = p.labelSpeakers(ctx, r, heard, text)
+				}
+				if _, ok := err.(truncatedError); ok && text != "" {
+					// A partial entry beats losing the whole thing
+					logf(ctx, "Saving partial transcript: %v", err)
+					truncated = true
+				} else if err != nil {
+					return err
+				}
+				// A channel that needed no translation is its own
+				// original
+				untranslated := result.Original
+				if untranslated != "" {
+					translated = true
+				} else {
+					untranslated = result.Text
+				}
+				if len(prepared) > 1 {
+					text = "Speaker " + speakerLabels[i:i+1] + ": " + strings.TrimSpace(text)
+					untranslated = "Speaker " + speakerLabels[i:i+1] + ": " + strings.TrimSpace(untranslated)
+				}
+				texts = append(texts, text)
+				originals = append(originals, untranslated)
+				confidence += result.Confidence / float64(len(prepared))
+				language = result.Language
+				segments = append(segments, result.Segments...)
+			}
+			// Separated channels overlap in time
+			sort.SliceStable(segments, func(i, j int) bool {
+				return segments[i].Start < segments[j].Start
+			})
+			transcript = strings.Join(texts, "\n\n")
+			if translated {
+				original = strings.Join(originals, "\n\n")
+			}
+			return nil
+		}},
+	}
+	// Steps that turn the transcript into entries
+	transcriptSteps := []pipelineStep{
+		{"postprocess transcript", func() error {
+			if cfg.ArchiveOriginalTranscript && p.archiver != nil {
+				// Kept before anything is changed, in case a filler or
+				// redaction took something that was meant
+				if err := p.archiver.archiveTranscript(ctx, rec.Sid, transcript); err != nil {
+					logf(ctx, "archive original transcript failed: %v", err)
+				}
+			}
+			transcript = cleanTranscript(cfg, transcript, cfg.PostprocessCapitalize)
+			if original != "" {
+				original = cleanTranscript(cfg, original, cfg.PostprocessCapitalize)
+			}
+			// Segments are cleaned the same way, so that nothing
+			// redacted from the transcript shows up in them
+			cleanSegments(cfg, segments)
+			logf(ctx, "Transcript (confidence %.2f): %s", confidence, transcript)
+			if words := wordCount(transcript); words < cfg.MinWords {
+				logf(ctx, "Skipping transcript with fewer than minimum words: %s (%d)", rec.Sid, words)
+				return errSkipRecording
+			}
+			return nil
+		}},
+		{"archive latest entry", func() error {
+			if cfg.DeletePhrase == "" || !isSpokenCommand(transcript, cfg.DeletePhrase) {
+				return nil
+			}
+			id, err := archiveLatestEntry(ctx, cfg, rec.Caller)
+			if err == errSharedTarget {
+				// Validation leaves only callers let in by a disabled
+				// whitelist here. The command is still dropped rather
+				// than saved as an entry.
+				logf(ctx, "Delete phrase heard, but not archiving: the latest entry in a shared notion target may be another caller's")
+				return errSkipRecording
+			} else if err != nil {
+				return err
+			}
+			logf(ctx, "Delete phrase heard, archived latest entry: %s", id)
+			return errSkipRecording
+		}},
+		{saveStage, func() error {
+			result := transcriptResult{Text: transcript, Confidence: confidence, Language: language, Segments: segments, Original: original}
+			// The rest of the pipeline is done with either way, so the
+			// error is returned once the audio is cleaned up
+			saveErr = p.saveEntries(ctx, rec, result, truncated)
+			return nil
+		}},
+	}
+
+	steps := append(audioSteps, transcriptSteps...)
+	if t, ok := p.transcriber.(urlTranscriber); ok && t.fetchesRecordings() && rec.Encryption == "" && !cfg.SpeakerSeparation {
+		// The transcriber fetches the recording itself, so it's never
+		// downloaded or prepared here
+		steps = append([]pipelineStep{{"transcribe recording", func() error {
+			defer timer(ctx, transcriptionTimer)()
+			result, err := t.TranscribeUrl(ctx, rec.Url, cfg.transcribeOptions(rec.Caller))
+			transcript, confidence, language, segments = result.Text, result.Confidence, result.Language, result.Segments
+			return err
+		}}}, transcriptSteps...)
+	}
+	if rec.TwilioTranscript != "" {
+		// Twilio transcribed it already, and its confidence isn't known
+		transcript, confidence = rec.TwilioTranscript, 1
+		steps = transcriptSteps
+	}
+
+	for _, step := range steps {
+		err := step.run()
+		if err == errSkipRecording {
+			discardPlaceholder(ctx, cfg, rec)
+			break
+		} else if err != nil {
+			return "", step.name, errors.Wrap(err, step.name+" failed")
+		}
+	}
+	// Entries that failed to save are kept in the failed store, so the
+	// audio is no longer needed either way
+	if p.raw != nil {
+		if err := p.raw.remove(rec.Sid); err != nil {
+			logf(ctx, "remove saved audio failed: %v", err)
+		}
+	}
+	if saveErr != nil {
+		return "", saveStage, saveErr
+	}
+	return transcript, "", nil
+}
+
+// Archival reads through its own section reader, so it can run alongside the
+// rest of the pipeline without sharing a read offset
+func (p *pipeline) archive(ctx context.Context, rec recording, recording *bytes.Reader) {
+	archived := io.NewSectionReader(recording, 0, recording.Size())
+	go func() {
+		err := p.archiver.archive(ctx, rec.Sid, archived, archived.Size())
+		if err != nil {
+			logf(ctx, "archive recording failed: %v", err)
+		}
+	}()
+}
+
+// Returned when some of a recording's entries couldn't be saved, after each
+// has been kept in the failed store under its own id
+type unsavedError struct {
+	ids     []string
+	entries int
+}
+
+func (e unsavedError) Error() string {
+	return fmt.Sprintf("%d of %d entries not saved: %s", len(e.ids), e.entries, strings.Join(e.ids, ", "))
+}
+
+// Whether a failure with the given id was recorded again
+func (e unsavedError) recorded(id string) bool {
+	for _, recorded := range e.ids {
+		if recorded == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Saves the transcript as one or more entries. Each entry that can't be saved
+// is kept in the failed store on its own, so that one failure doesn't hold up
+// the rest, and an unsavedError lists them.
+func (p *pipeline) saveEntries(ctx context.Context, rec recording, result transcriptResult, truncated bool) error {
+	cfg := p.cfg
+	pieces := []string{result.Text}
+	if cfg.SplitPhrase != "" {
+		pieces = splitTranscript(result.Text, cfg.SplitPhrase)
+		if len(pieces) > 1 {
+			logf(ctx, "Split phrase heard, saving %d entries", len(pieces))
+		}
+	}
+
+	now := time.Now().In(cfg.Timezone.loc())
+	var unsaved []string
+	for i, piece := range pieces {
+		e := entry{
+			Transcript:   piece,
+			Date:         now,
+			RecordedAt:   now,
+			Caller:       rec.Caller,
+			Duration:     rec.Duration,
+			RecordingSid: rec.Sid,
+			CallSid:      rec.CallSid,
+			Language:     result.Language,
+		}
+		if i == 0 {
+			e.PlaceholderPageId = rec.PlaceholderPageId
+		}
+		if len(pieces) == 1 {
+			// There's no telling which segments or what part of the
+			// original went into which piece
+			e.Segments = result.Segments
+			e.OriginalTranscript = result.Original
+		}
+		e.LowConfidence = result.Confidence < cfg.MinConfidence
+		if len(cfg.DatePhrases) > 0 {
+			date, body, matched, ok := parseSpokenDate(piece, cfg.DatePhrases, e.Date)
+			if ok {
+				e.Transcript, e.Date = body, date
+				logf(ctx, "Using spoken date: %s", date.Format("2006-01-02"))
+			} else if matched {
+				logf(ctx, "Could not understand spoken date, using today")
+			}
+		}
+		if cfg.RelationPhrase != "" {
+			if name, body, ok := spokenValue(e.Transcript, cfg.RelationPhrase); ok {
+				// The name is left in the transcript if there's no such
+				// page, so that it isn't lost
+				id, err := findRelatedPage(ctx, cfg, rec.Caller, name)
+				if err != nil {
+					logf(ctx, "find related page failed, using default: %v", err)
+				} else {
+					e.RelatedPageId, e.Transcript = id, body
+					logf(ctx, "Relating entry to %s (%s)", name, id)
+				}
+			}
+		}
+		if cfg.TitlePhrase != "" {
+			if title, body, ok := spokenValue(e.Transcript, cfg.TitlePhrase); ok {
+				e.Title, e.Transcript = title, body
+				logf(ctx, "Using spoken title: %s", title)
+			}
+		}
+		// Only the last piece is missing its end
+		if truncated && i == len(pieces)-1 {
+			e.Truncated = true
+			e.Transcript = strings.TrimSpace(e.Transcript) + " " + truncatedMarker
+		}
+
+		if cfg.TranscriptWebhook != "" {
+			enriched, err := enrichEntry(ctx, cfg, e)
+			if err != nil {
+				logf(ctx, "transcript webhook failed, using original transcript: %v", err)
+			} else {
+				e = enriched
+			}
+		}
+
+		if p.index != nil {
+			// The local copy is independent of the main store, so it's
+			// kept even if the upload fails
+			if err := p.index.Save(ctx, e); err != nil {
+				logf(ctx, "insert sqlite failed: %v", err)
+			}
+		}
+
+		if err := p.store.Save(ctx, e); err != nil {
+			err = errors.Wrap(err, saveStage+" failed")
+			logf(ctx, "%v", err)
+			id := rec.Sid
+			if i > 0 {
+				id = fmt.Sprintf("%s-%d", rec.Sid, i+1)
+			}
+			p.saveFailed(ctx, failedEntry{Id: id, Recording: rec, Entry: e, Stage: saveStage, Error: err.Error()})
+			unsaved = append(unsaved, id)
+			continue
+		}
+		stats.saved.Add(1)
+	}
+
+	// Only once every entry is safely saved, since the recording is what a
+	// failed entry would be retried from
+	if len(unsaved) > 0 {
+		return unsavedError{ids: unsaved, entries: len(pieces)}
+	}
+	if cfg.DeleteTwilioRecording {
+		if err := deleteRecording(ctx, cfg, rec); err != nil {
+			logf(ctx, "delete twilio recording failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) saveFailed(ctx context.Context, f failedEntry) {
+	stats.fail(f.Stage)
+	if p.failed == nil {
+		return
+	}
+	f.FailedAt = time.Now()
+	if err := p.failed.save(f); err != nil {
+		logf(ctx, "save failed entry failed: %v", err)
+	}
+}
+
+// Retries a failed entry from the stage that failed: entries that couldn't be
+// saved are saved again, and anything earlier reruns the whole pipeline. The
+// failure is resolved once the retry succeeds; if the rerun got as far as
+// saving but some entries failed, those are recorded again in its place.
+func (p *pipeline) retry(ctx context.Context, f failedEntry) error {
+	// Entries recorded before stages were tracked all failed to save
+	if f.Stage == saveStage || f.Stage == "" {
+		if err := p.store.Save(ctx, f.Entry); err != nil {
+			return err
+		}
+		return p.resolveFailed(f.Id)
+	}
+	_, _, err := p.run(ctx, f.Recording)
+	if unsaved, ok := err.(unsavedError); ok && !unsaved.recorded(f.Id) {
+		// The rest of the entries are the new failures, which are left
+		// to be retried on their own
+		if err := p.resolveFailed(f.Id); err != nil {
+			logf(ctx, "resolve failed entry %s failed: %v", f.Id, err)
+		}
+	} else if err == nil {
+		return p.resolveFailed(f.Id)
+	}
+	return err
+}
+
+func (p *pipeline) resolveFailed(id string) error {
+	if p.failed == nil {
+		return nil
+	}
+	return p.failed.resolve(id)
+}
+
+// Keeps a recording that arrived before the model was loaded in the failed
+// store until retryWaiting picks it up. Returns false without keeping it if
+// the model has loaded since, since retryWaiting may already have run.
+func (p *pipeline) keepWaiting(ctx context.Context, rec recording) bool {
+	p.waitingMu.Lock()
+	defer p.waitingMu.Unlock()
+	if p.models.ready() {
+		return false
+	}
+	logf(ctx, "%v", errModelNotReady)
+	p.saveFailed(ctx, failedEntry{Id: rec.Sid, Recording: rec, Stage: modelStage, Error: errModelNotReady.Error()})
+	return true
+}
+
+// Queues a retry of every recording that arrived before the model was loaded
+func (p *pipeline) retryWaiting(queue *workQueue) {
+	p.waitingMu.Lock()
+	defer p.waitingMu.Unlock()
+	p.retryPending(queue, func(f failedEntry) bool {
+		return f.Stage == modelStage
+	})
+}
+
+// Periodically queues a retry of every recording that failed before its
+// entries were saved, and whose audio was saved
+func (p *pipeline) retrySavedAudio(queue *workQueue, interval time.Duration) {
+	for range time.Tick(interval) {
+		p.retryPending(queue, func(f failedEntry) bool {
+			return f.Stage != saveStage && f.Stage != "" && p.raw.has(f.Recording.Sid)
+		})
+	}
+}
+
+// Queues a retry of every pending failed entry that matches
+func (p *pipeline) retryPending(queue *workQueue, match func(failedEntry) bool) {
+	entries, err := p.failed.pending()
+	if err != nil {
+		logf(context.Background(), "list failed entries failed: %v", err)
+		return
+	}
+	for _, f := range entries {
+		if !match(f) {
+			continue
+		}
+		f := f
+		ctx := withCallSid(context.Background(), f.Recording.CallSid)
+		enqueued := queue.tryEnqueue(func() {
+			if err := p.retry(ctx, f); err != nil {
+				logf(ctx, "retry recording %s failed: %v", f.Id, err)
+			}
+		})
+		if !enqueued {
+			logf(ctx, "Queue full, leaving recording %s for a manual retry", f.Id)
+		}
+	}
+}
+
+// Removes filler words, corrects the vocabulary, redacts, capitalizes, and
+// masks profanity, as configured. Segments aren't capitalized, since they can
+// start mid-sentence.
+func cleanTranscript(cfg config, text string, capitalize bool) string {
+	if cfg.RemoveFillers {
+		text = removeFillers(text, cfg.FillerWords)
+	}
+	if len(cfg.Vocabulary) > 0 {
+		text = correctVocabulary(text, cfg.Vocabulary)
+	}
+	if cfg.Redact {
+		text = redactTranscript(text, cfg.RedactPatterns)
+	}
+	if capitalize {
+		text = capitalizeSentences(text)
+	}
+	if cfg.MaskProfanity {
+		text = maskProfanity(text, cfg.ProfanityWords)
+	}
+	return text
+}
+
+// Cleans segments as cleanTranscript does the transcript. Redaction looks
+// across them, since a number can be split between segments.
+func cleanSegments(cfg config, segments []timedSegment) {
+	redact := cfg.Redact
+	cfg.Redact = false
+	for i := range segments {
+		segments[i].Text = cleanTranscript(cfg, segments[i].Text, false)
+	}
+	if redact {
+		redactSegments(segments, cfg.RedactPatterns)
+	}
+}
+
+// Labels who said what in a recording's transcript, falling back to the
+// unlabeled transcript if diarization fails or only one speaker was heard
+func (p *pipeline) labelSpeakers(ctx context.Context, recording *bytes.Reader, segments []whisper.Segment, transcript string) string {
+	if len(segments) == 0 {
+		logf(ctx, "Transcriber gave no segments, skipping diarization")
+		return transcript
+	}
+	turns, err := diarizeRecording(ctx, p.cfg, recording)
+	if err != nil {
+		logf(ctx, "diarize recording failed: %v", err)
+		return transcript
+	}
+	if len(turns) == 0 {
+		return transcript
+	}
+	if labeled, ok := labelSpeakers(segments, turns); ok {
+		return labeled
+	}
+	return transcript
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func newWaitingPipeline(t *testing.T) *pipeline {
+	t.Helper()
+	failed, err := newFailedStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pipeline{models: newModelHolder(1), failed: failed}
+}
+
+// A recording that arrives while the model loads is kept for retryWaiting
+func TestProcessRecordingKeepsWaiting(t *testing.T) {
+	p := newWaitingPipeline(t)
+	p.processRecording(context.Background(), recording{Sid: "RE1"})
+
+	pending, err := p.failed.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Id != "RE1" || pending[0].Stage != modelStage {
+		t.Errorf("pending = %+v, want RE1 waiting for the model", pending)
+	}
+}
+
+// Once the model has loaded, retryWaiting may already have listed the failed
+// store, so a recording that just missed it isn't kept there
+func TestKeepWaitingAfterLoad(t *testing.T) {
+	p := newWaitingPipeline(t)
+	p.models.giveUp()
+	if p.keepWaiting(context.Background(), recording{Sid: "RE1"}) {
+		t.Error("kept a recording waiting after the model loaded")
+	}
+	pending, err := p.failed.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending = %+v, want none", pending)
+	}
+}
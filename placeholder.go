@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dstotijn/go-notion"
+)
+
+// Prefix of placeholder page titles, also used to keep placeholders from
+// being mistaken for the latest entry
+const placeholderTitlePrefix = "Processing… "
+
+// Returned when the placeholder was deleted or archived while the recording
+// was transcribed, so the entry needs a page of its own
+var errPlaceholderGone = errors.New("placeholder page is gone")
+
+// Creates a page to show that a recording was received while it waits to be
+// transcribed, returning its ID. The entry is filled in later by
+// fillPlaceholder.
+func createPlaceholder(ctx context.Context, cfg config, caller string, receivedAt time.Time) (string, error) {
+	defer timer(ctx, "create placeholder")()
+
+	target := cfg.notionTarget(caller)
+	title := []notion.RichText{
+		{Text: &notion.Text{Content: placeholderTitlePrefix + "(" + cfg.Locale.time(receivedAt) + ")"}},
+	}
+	params := notion.CreatePageParams{Cover: cfg.pageCover(caller)}
+	if cfg.NotionParentType == "page" {
+		params.ParentType = notion.ParentTypePage
+		params.ParentID = target.PageId
+		params.Title = title
+	} else {
+		params.ParentType = notion.ParentTypeDatabase
+		params.ParentID = target.DatabaseId
+		params.DatabasePageProperties = &notion.DatabasePageProperties{
+			"Date":  notion.DatabasePageProperty{Date: &notion.Date{Start: notion.NewDateTime(receivedAt, false)}},
+			"Title": notion.DatabasePageProperty{Title: title},
+		}
+	}
+
+	page, err := cfg.notionClient(target.Token).CreatePage(ctx, params)
+	return page.ID, err
+}
+
+// Turns a placeholder page into the entry, setting its properties and icon
+// and adding the entry's blocks. Placeholders are created empty, so blocks
+// already on the page were added by an earlier attempt that failed partway,
+// and only the rest are added.
+func fillPlaceholder(ctx context.Context, cfg config, pageId string, e entry) error {
+	defer timer(ctx, "fill placeholder")()
+
+	e.Transcript = sanitizeForNotion(e.Transcript)
+	e.Summary = sanitizeForNotion(e.Summary)
+	e.OriginalTranscript = sanitizeForNotion(e.OriginalTranscript)
+
+	params := notion.UpdatePageParams{}
+	if cfg.NotionParentType == "page" {
+		params.DatabasePageProperties = notion.DatabasePageProperties{
+			"title": notion.DatabasePageProperty{
+				Title: []notion.RichText{{Text: &notion.Text{Content: entryTitle(e, cfg.DefaultTitle)}}},
+			},
+		}
+	} else {
+		params.DatabasePageProperties = *databasePageProperties(cfg, e)
+	}
+	if cfg.NotionSentimentIcon {
+		emoji := sentimentEmoji(e.Transcript)
+		params.Icon = &notion.Icon{Type: notion.IconTypeEmoji, Emoji: &emoji}
+	}
+
+	notionClient := cfg.notionClient(cfg.notionTarget(e.Caller).Token)
+	page, err := notionClient.FindPageByID(ctx, pageId)
+	if errors.Is(err, notion.ErrObjectNotFound) || (err == nil && page.Archived) {
+		return errPlaceholderGone
+	} else if err != nil {
+		return err
+	}
+	appended, err := countChildBlocks(ctx, notionClient, pageId)
+	if err != nil {
+		return err
+	}
+
+	// Blocks are only added once the properties are set
+	if appended == 0 {
+		_, err := notionClient.UpdatePage(ctx, pageId, params)
+		if errors.Is(err, notion.ErrObjectNotFound) {
+			return errPlaceholderGone
+		} else if err != nil {
+			return err
+		}
+	}
+	blocks := entryBlocks(cfg, e)
+	if appended > 0 {
+		logf(ctx, "Placeholder already has %d of %d blocks, adding the rest", appended, len(blocks))
+	}
+	if appended >= len(blocks) {
+		return nil
+	}
+	return appendBlocks(ctx, notionClient, pageId, blocks[appended:])
+}
+
+// Returns the number of blocks directly under the block or page
+func countChildBlocks(ctx context.Context, notionClient *notion.Client, blockId string) (int, error) {
+	count := 0
+	query := &notion.PaginationQuery{PageSize: maxChildBlocks}
+	for {
+		result, err := notionClient.FindBlockChildrenByID(ctx, blockId, query)
+		if err != nil {
+			return 0, err
+		}
+		count += len(result.Results)
+		if !result.HasMore || result.NextCursor == nil {
+			return count, nil
+		}
+		query.StartCursor = *result.NextCursor
+	}
+}
+
+// Archives the placeholder of a recording that won't become an entry
+func discardPlaceholder(ctx context.Context, cfg config, rec recording) {
+	if rec.PlaceholderPageId == "" {
+		return
+	}
+	archived := true
+	notionClient := cfg.notionClient(cfg.notionTarget(rec.Caller).Token)
+	_, err := notionClient.UpdatePage(ctx, rec.PlaceholderPageId, notion.UpdatePageParams{Archived: &archived})
+	if err != nil {
+		logf(ctx, "discard placeholder failed: %v", err)
+	}
+}
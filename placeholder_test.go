@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A Notion workspace with a single placeholder page, recording the requests
+// made to it
+type fakePlaceholderNotion struct {
+	mu       sync.Mutex
+	exists   bool
+	archived bool
+	// Blocks already on the placeholder
+	children int
+	// Whether UpdatePage fails, as if Notion had an outage
+	failUpdate bool
+	updates    int
+	appended   []int
+	created    int
+}
+
+func (n *fakePlaceholderNotion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	page := func(id string) string {
+		return fmt.Sprintf(`{"object": "page", "id": %q, "archived": %t, "parent": {"type": "page_id", "page_id": "parent-id"}, "properties": {}}`, id, n.archived)
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"object": "error", "status": 404, "code": "object_not_found", "message": "not found"}`)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/pages/placeholder-id":
+		if !n.exists {
+			notFound()
+			return
+		}
+		fmt.Fprint(w, page("placeholder-id"))
+	case r.Method == http.MethodPatch && r.URL.Path == "/v1/pages/placeholder-id":
+		if !n.exists {
+			notFound()
+			return
+		}
+		n.updates++
+		if n.failUpdate {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"object": "error", "status": 503, "code": "service_unavailable", "message": "unavailable"}`)
+			return
+		}
+		fmt.Fprint(w, page("placeholder-id"))
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/blocks/placeholder-id/children":
+		blocks := make([]string, n.children)
+		for i := range blocks {
+			blocks[i] = fmt.Sprintf(`{"object": "block", "id": "block-%d", "type": "paragraph", "paragraph": {"rich_text": []}}`, i)
+		}
+		fmt.Fprintf(w, `{"object": "list", "results": [%s], "has_more": false}`, strings.Join(blocks, ","))
+	case r.Method == http.MethodPatch && r.URL.Path == "/v1/blocks/placeholder-id/children":
+		var body struct {
+			Children []json.RawMessage `json:"children"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		n.appended = append(n.appended, len(body.Children))
+		n.children += len(body.Children)
+		fmt.Fprint(w, `{"object": "list", "results": [], "has_more": false}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/pages":
+		n.created++
+		fmt.Fprint(w, page("new-page-id"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"object": "error", "status": 400, "code": "validation_error", "message": "unexpected %s %s"}`, r.Method, r.URL.Path)
+	}
+}
+
+// Has cfg.notionClient return a client for the fake workspace
+func useFakeNotion(t *testing.T, handler http.Handler) config {
+	t.Helper()
+	token := "test-token-" + t.Name()
+	notionClients.Store(token, newTestNotionClient(t, handler))
+	t.Cleanup(func() { notionClients.Delete(token) })
+	return config{
+		NotionAuthToken:  token,
+		NotionParentType: "page",
+		NotionPageId:     "parent-id",
+		DefaultTitle:     "Journal entry",
+		BodyBlock:        "paragraph",
+		BodyDivider:      true,
+	}
+}
+
+func testPlaceholderEntry() entry {
+	return entry{
+		Transcript:        "Went for a walk by the river.",
+		Summary:           "A walk.",
+		Caller:            testCaller,
+		PlaceholderPageId: "placeholder-id",
+	}
+}
+
+func TestFillPlaceholder(t *testing.T) {
+	notion := &fakePlaceholderNotion{exists: true}
+	cfg := useFakeNotion(t, notion)
+	e := testPlaceholderEntry()
+	blocks := len(entryBlocks(cfg, e))
+
+	if err := fillPlaceholder(context.Background(), cfg, "placeholder-id", e); err != nil {
+		t.Fatal(err)
+	}
+	if notion.updates != 1 || fmt.Sprint(notion.appended) != fmt.Sprint([]int{blocks}) {
+		t.Errorf("updated %d times and appended %v, want once and [%d]", notion.updates, notion.appended, blocks)
+	}
+}
+
+// A retry after the blocks were partly added only adds the rest
+func TestFillPlaceholderResumes(t *testing.T) {
+	notion := &fakePlaceholderNotion{exists: true, children: 2}
+	cfg := useFakeNotion(t, notion)
+	e := testPlaceholderEntry()
+	blocks := len(entryBlocks(cfg, e))
+	if blocks <= 2 {
+		t.Fatalf("entry has %d blocks, want more than 2", blocks)
+	}
+
+	if err := fillPlaceholder(context.Background(), cfg, "placeholder-id", e); err != nil {
+		t.Fatal(err)
+	}
+	if notion.updates != 0 || fmt.Sprint(notion.appended) != fmt.Sprint([]int{blocks - 2}) {
+		t.Errorf("updated %d times and appended %v, want none and [%d]", notion.updates, notion.appended, blocks-2)
+	}
+
+	// Filled completely, so another retry does nothing
+	notion.appended = nil
+	if err := fillPlaceholder(context.Background(), cfg, "placeholder-id", e); err != nil {
+		t.Fatal(err)
+	}
+	if notion.updates != 0 || len(notion.appended) != 0 {
+		t.Errorf("updated %d times and appended %v to a filled placeholder, want nothing", notion.updates, notion.appended)
+	}
+}
+
+func TestFillPlaceholderUpdateFails(t *testing.T) {
+	notion := &fakePlaceholderNotion{exists: true, failUpdate: true}
+	cfg := useFakeNotion(t, notion)
+
+	err := fillPlaceholder(context.Background(), cfg, "placeholder-id", testPlaceholderEntry())
+	if err == nil || err == errPlaceholderGone {
+		t.Errorf("fillPlaceholder() = %v, want the update's error", err)
+	}
+	if len(notion.appended) != 0 {
+		t.Errorf("appended %v after the update failed, want nothing", notion.appended)
+	}
+}
+
+func TestFillPlaceholderGone(t *testing.T) {
+	for _, notion := range []*fakePlaceholderNotion{
+		{exists: false},
+		{exists: true, archived: true},
+	} {
+		cfg := useFakeNotion(t, notion)
+		err := fillPlaceholder(context.Background(), cfg, "placeholder-id", testPlaceholderEntry())
+		if err != errPlaceholderGone {
+			t.Errorf("exists=%t archived=%t: fillPlaceholder() = %v, want %v", notion.exists, notion.archived, err, errPlaceholderGone)
+		}
+	}
+}
+
+// An entry whose placeholder was deleted gets a page of its own
+func TestNotionStoreSaveWithoutPlaceholder(t *testing.T) {
+	notion := &fakePlaceholderNotion{exists: false}
+	cfg := useFakeNotion(t, notion)
+	store := &NotionStore{cfg: cfg, sessions: newNotionSessions(0)}
+
+	if err := store.Save(context.Background(), testPlaceholderEntry()); err != nil {
+		t.Fatal(err)
+	}
+	if notion.created != 1 {
+		t.Errorf("created %d pages, want 1", notion.created)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Used when masking is enabled without a word list
+var defaultProfanity = []string{
+	"fuck", "fucking", "fucked", "shit", "shitty", "bitch", "asshole",
+	"bastard", "dick", "piss", "pissed", "crap", "damn",
+}
+
+// Replaces each whole-word match of words in the transcript with asterisks,
+// so that "class" survives a list containing "ass"
+func maskProfanity(transcript string, words []string) string {
+	if len(words) == 0 {
+		words = defaultProfanity
+	}
+	var quoted []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return transcript
+	}
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return re.ReplaceAllStringFunc(transcript, func(match string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(match))
+	})
+}
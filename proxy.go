@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maps TRUSTED_PLATFORM values to the header gin should trust for the client
+// IP. Any other non-empty value is used as the header name itself.
+var trustedPlatforms = map[string]string{
+	"cloudflare": gin.PlatformCloudflare,
+	"google":     gin.PlatformGoogleAppEngine,
+}
+
+func trustedPlatformHeader(platform string) string {
+	if header, ok := trustedPlatforms[strings.ToLower(platform)]; ok {
+		return header
+	}
+	return platform
+}
+
+// Parses a list of IPs and CIDRs, in the same format that gin accepts for
+// trusted proxies
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first value of a possibly comma-separated forwarding header
+func forwardedValue(c *gin.Context, header string) string {
+	value, _, _ := strings.Cut(c.GetHeader(header), ",")
+	return strings.TrimSpace(value)
+}
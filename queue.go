@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// A bounded queue of jobs processed by a fixed number of workers, so that a
+// burst of recording callbacks can't start an unbounded number of pipelines
+// at once.
+type workQueue struct {
+	// Guards closing jobs against jobs still being added
+	mu      sync.RWMutex
+	closed  bool
+	jobs    chan func()
+	workers sync.WaitGroup
+	dropped atomic.Int64
+}
+
+func newWorkQueue(size, workers int) *workQueue {
+	q := &workQueue{jobs: make(chan func(), size)}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.workers.Done()
+			for job := range q.jobs {
+				job()
+			}
+		}()
+	}
+	return q
+}
+
+// Adds a job to the queue without blocking. Returns false, and counts the job
+// as dropped, if the queue is full.
+func (q *workQueue) tryEnqueue(job func()) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.dropped.Add(1)
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+func (q *workQueue) depth() int {
+	return len(q.jobs)
+}
+
+func (q *workQueue) capacity() int {
+	return cap(q.jobs)
+}
+
+// Stops taking jobs and waits for the ones already queued to finish, or for
+// the context to be done
+func (q *workQueue) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkQueueDrain(t *testing.T) {
+	q := newWorkQueue(10, 2)
+	var done atomic.Int64
+	for i := 0; i < 5; i++ {
+		if !q.tryEnqueue(func() {
+			time.Sleep(10 * time.Millisecond)
+			done.Add(1)
+		}) {
+			t.Fatal("queue with room refused a job")
+		}
+	}
+
+	if err := q.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := done.Load(); n != 5 {
+		t.Errorf("%d jobs done after draining, want 5", n)
+	}
+	if q.tryEnqueue(func() {}) {
+		t.Error("drained queue took a job")
+	}
+	if n := q.dropped.Load(); n != 1 {
+		t.Errorf("%d jobs dropped, want 1", n)
+	}
+}
+
+func TestWorkQueueDrainTimeout(t *testing.T) {
+	q := newWorkQueue(1, 1)
+	release := make(chan struct{})
+	defer close(release)
+	q.tryEnqueue(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("drain() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Keeps downloaded recordings on disk, named by their sid, until they've been
+// turned into entries. A recording that fails can then be retried from the
+// saved copy after Twilio's is gone.
+type rawAudioStore struct {
+	dir string
+}
+
+func newRawAudioStore(dir string) (*rawAudioStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "create raw audio dir failed")
+	}
+	return &rawAudioStore{dir: dir}, nil
+}
+
+func (s *rawAudioStore) path(sid string) (string, error) {
+	if !recordingSidPattern.MatchString(sid) {
+		return "", fmt.Errorf("invalid recording sid: %q", sid)
+	}
+	return filepath.Join(s.dir, sid+".audio"), nil
+}
+
+// Writes the recording without moving its read offset
+func (s *rawAudioStore) save(sid string, recording *bytes.Reader) error {
+	path, err := s.path(sid)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(recording, 0, recording.Size()))
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns the saved recording, or nil if there isn't one
+func (s *rawAudioStore) load(sid string) (*bytes.Reader, error) {
+	path, err := s.path(sid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (s *rawAudioStore) has(sid string) bool {
+	path, err := s.path(sid)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (s *rawAudioStore) remove(sid string) error {
+	path, err := s.path(sid)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
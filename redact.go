@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redactedText = "[redacted]"
+
+// Used when redaction is enabled without any patterns. Matches runs of nine or
+// more digits, optionally separated by spaces or dashes, which covers social
+// security, credit card, and bank account numbers.
+var defaultRedactPatterns = []pattern{
+	{regexp.MustCompile(`\d(?:[ -]?\d){8,}`)},
+}
+
+// A regular expression that is compiled when the config is parsed
+type pattern struct {
+	*regexp.Regexp
+}
+
+func (p *pattern) UnmarshalText(text []byte) error {
+	re, err := regexp.Compile(string(text))
+	if err != nil {
+		return err
+	}
+	p.Regexp = re
+	return nil
+}
+
+// Masks every match of patterns in the transcript
+func redactTranscript(transcript string, patterns []pattern) string {
+	if len(patterns) == 0 {
+		patterns = defaultRedactPatterns
+	}
+	for _, p := range patterns {
+		transcript = p.ReplaceAllLiteralString(transcript, redactedText)
+	}
+	return transcript
+}
+
+// Masks every match of patterns in the segments' text as if it were one
+// transcript, so that a number split between segments is caught as well. A
+// match is masked in the first segment it covers and cut from the rest.
+func redactSegments(segments []timedSegment, patterns []pattern) {
+	if len(patterns) == 0 {
+		patterns = defaultRedactPatterns
+	}
+	for _, p := range patterns {
+		var joined strings.Builder
+		starts := make([]int, len(segments))
+		for i, segment := range segments {
+			if i > 0 {
+				joined.WriteByte(' ')
+			}
+			starts[i] = joined.Len()
+			joined.WriteString(segment.Text)
+		}
+		text := joined.String()
+		matches := p.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		masked := make([]bool, len(matches))
+		for i := range segments {
+			start, end := starts[i], starts[i]+len(segments[i].Text)
+			var redacted strings.Builder
+			pos := start
+			for j, m := range matches {
+				if m[0] >= end || m[1] <= start {
+					continue
+				}
+				if m[0] > pos {
+					redacted.WriteString(text[pos:m[0]])
+				}
+				if !masked[j] {
+					redacted.WriteString(redactedText)
+					masked[j] = true
+				}
+				pos = m[1]
+				if pos > end {
+					pos = end
+				}
+			}
+			redacted.WriteString(text[pos:end])
+			segments[i].Text = strings.TrimSpace(redacted.String())
+		}
+	}
+}
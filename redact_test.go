@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestRedactSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		patterns []pattern
+		want     []string
+	}{
+		{
+			"within a segment",
+			[]string{"My card is 4111 1111 1111 1111.", "Thanks."},
+			nil,
+			[]string{"My card is [redacted].", "Thanks."},
+		},
+		{
+			"split between segments",
+			[]string{"My number is 123 45", "6789, got it?"},
+			nil,
+			[]string{"My number is [redacted]", ", got it?"},
+		},
+		{
+			"across three segments",
+			[]string{"It's 1234", "5678", "9012 there."},
+			nil,
+			[]string{"It's [redacted]", "", "there."},
+		},
+		{
+			"too short either way",
+			[]string{"Room 1234", "and floor 5."},
+			nil,
+			[]string{"Room 1234", "and floor 5."},
+		},
+		{
+			"custom pattern",
+			[]string{"Email me at jane@", "example.com please"},
+			[]pattern{{regexp.MustCompile(`\S+@ ?\S+`)}},
+			[]string{"Email me at [redacted]", "please"},
+		},
+	}
+	for _, test := range tests {
+		segments := make([]timedSegment, len(test.segments))
+		for i, text := range test.segments {
+			segments[i] = timedSegment{Start: float64(i), End: float64(i + 1), Text: text}
+		}
+		redactSegments(segments, test.patterns)
+		var got []string
+		for i, segment := range segments {
+			got = append(got, segment.Text)
+			if segment.Start != float64(i) || segment.End != float64(i+1) {
+				t.Errorf("%s: segment %d moved to %v-%v", test.name, i, segment.Start, segment.End)
+			}
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%s: redacted to %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dstotijn/go-notion"
+	"github.com/pkg/errors"
+)
+
+// Finds the page titled name, ignoring case, for the entry's relation
+// property. Only pages in NOTION_RELATION_DATABASE are considered if it's set.
+func findRelatedPage(ctx context.Context, cfg config, caller, name string) (string, error) {
+	defer timer(ctx, "find related page")()
+
+	notionClient := cfg.notionClient(cfg.notionTarget(caller).Token)
+	res, err := notionClient.Search(ctx, &notion.SearchOpts{
+		Query:  name,
+		Filter: &notion.SearchFilter{Property: "object", Value: "page"},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, result := range res.Results {
+		page, ok := result.(notion.Page)
+		if !ok || !strings.EqualFold(strings.TrimSpace(anyPageTitle(page)), name) {
+			continue
+		}
+		if cfg.NotionRelationDatabase != "" && !sameNotionId(page.Parent.DatabaseID, cfg.NotionRelationDatabase) {
+			continue
+		}
+		return page.ID, nil
+	}
+	return "", errors.Errorf("no page titled %q", name)
+}
+
+// Returns the plain text title of any page, whatever its title property is
+// called
+func anyPageTitle(page notion.Page) string {
+	var richTexts []notion.RichText
+	switch properties := page.Properties.(type) {
+	case notion.DatabasePageProperties:
+		for _, property := range properties {
+			if property.Title != nil {
+				richTexts = property.Title
+			}
+		}
+	case notion.PageProperties:
+		richTexts = properties.Title.Title
+	}
+	var sb strings.Builder
+	for _, richText := range richTexts {
+		sb.WriteString(richText.PlainText)
+	}
+	return sb.String()
+}
+
+// Compares Notion IDs, which the API returns with dashes but are often
+// copied from URLs without them
+func sameNotionId(a, b string) bool {
+	return strings.ReplaceAll(a, "-", "") == strings.ReplaceAll(b, "-", "")
+}
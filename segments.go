@@ -0,0 +1,210 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+)
+
+// A stretch of the transcript and where it falls in the recording, in seconds
+type timedSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+func newTimedSegment(segment whisper.Segment) timedSegment {
+	return timedSegment{
+		Start: segment.Start.Seconds(),
+		End:   segment.End.Seconds(),
+		Text:  strings.TrimSpace(segment.Text),
+	}
+}
+
+// Follows words whisper was unsure of. The bindings only expose the
+// probability of the token whisper chose, not the ones it passed over, so
+// there's no alternative to show.
+const uncertainMarker = " [?]"
+
+// Fewest words two adjacent segments must share before the repeated words are
+// treated as an artifact rather than something that was actually said twice
+const minSegmentOverlap = 3
+
+// Collapses repetition that whisper tends to introduce between adjacent
+// segments: a segment that repeats the previous one is dropped, and a segment
+// that starts with the words the previous one ended with has them removed.
+// Repetition within a segment is left alone.
+func dedupeSegments(segments []string) []string {
+	var deduped []string
+	var prevWords []string
+	for _, segment := range segments {
+		words := strings.Fields(segment)
+		if len(words) == 0 {
+			continue
+		}
+		if prevWords != nil && equalWords(words, prevWords) {
+			continue
+		}
+		if n := segmentOverlap(prevWords, words); n > 0 {
+			segment = " " + strings.Join(words[n:], " ")
+		}
+		deduped = append(deduped, segment)
+		prevWords = words
+	}
+	return deduped
+}
+
+// Returns the number of leading words of next that repeat the trailing words
+// of prev, or 0 if fewer than minSegmentOverlap words match. The overlap never
+// covers all of next, since a full repeat is handled separately.
+func segmentOverlap(prev, next []string) int {
+	for n := len(next) - 1; n >= minSegmentOverlap; n-- {
+		if n <= len(prev) && equalWords(prev[len(prev)-n:], next[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+func equalWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if normalizeWord(a[i]) != normalizeWord(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeWord(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, unicode.IsPunct))
+}
+
+// Splits a transcript wherever the phrase is spoken, dropping the phrase
+// itself and any pieces left empty, e.g. when it's said at the very start
+func splitTranscript(transcript, phrase string) []string {
+	words := strings.Fields(phrase)
+	if len(words) == 0 {
+		return []string{transcript}
+	}
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	delimiter := regexp.MustCompile(`(?i)\b` + strings.Join(words, `[\s[:punct:]]+`) + `\b[[:punct:]]*`)
+	if !delimiter.MatchString(transcript) {
+		return []string{transcript}
+	}
+
+	var pieces []string
+	for _, piece := range delimiter.Split(transcript, -1) {
+		piece = capitalizeFirst(strings.TrimSpace(piece))
+		if strings.TrimFunc(piece, unicode.IsPunct) != "" {
+			pieces = append(pieces, piece)
+		}
+	}
+	if len(pieces) == 0 {
+		return []string{transcript}
+	}
+	return pieces
+}
+
+// Takes what's spoken after the phrase at the start of the transcript, up to
+// the end of its sentence, like the title in "Title: grocery ideas. We need
+// eggs". Returns it and the rest of the transcript, or false if the transcript
+// doesn't start with the phrase.
+func spokenValue(transcript, phrase string) (value, body string, ok bool) {
+	words := strings.Fields(phrase)
+	if len(words) == 0 {
+		return "", transcript, false
+	}
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	re := regexp.MustCompile(`(?i)^\s*` + strings.Join(words, `[\s[:punct:]]+`) + `\b[[:punct:]]*\s+([^.!?\n]+)[.!?]*`)
+	match := re.FindStringSubmatchIndex(transcript)
+	if match == nil {
+		return "", transcript, false
+	}
+	value = capitalizeFirst(strings.TrimRightFunc(transcript[match[2]:match[3]], func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}))
+	if value == "" {
+		return "", transcript, false
+	}
+	return value, capitalizeFirst(strings.TrimSpace(transcript[match[1]:])), true
+}
+
+// Matches the pronoun "i", along with what follows it when it's actually
+// part of an abbreviation like "i.e."
+var lowercaseI = regexp.MustCompile(`\bi\b(\.[a-z])?`)
+
+// Capitalizes the first letter of each sentence and the pronoun "I", for
+// models that transcribe in lowercase
+func capitalizeSentences(text string) string {
+	text = lowercaseI.ReplaceAllStringFunc(text, func(match string) string {
+		if len(match) > 1 {
+			return match
+		}
+		return "I"
+	})
+
+	// A sentence starts at the beginning of the text, or after a terminal
+	// punctuation mark that's followed by a space
+	runes := []rune(text)
+	sentenceStart, sentenceEnd := true, false
+	for i, r := range runes {
+		switch {
+		case r == '.' || r == '!' || r == '?':
+			sentenceEnd = true
+		case unicode.IsSpace(r):
+			sentenceStart = sentenceStart || sentenceEnd
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if sentenceStart {
+				runes[i] = unicode.ToUpper(r)
+			}
+			sentenceStart, sentenceEnd = false, false
+		}
+	}
+	return string(runes)
+}
+
+// Rebuilds a segment's text from its tokens, marking each word that contains
+// a token with a probability below threshold. Words start at tokens with a
+// leading space, since that's how whisper's tokenizer splits them.
+func markUncertainWords(tokens []whisper.Token, isText func(whisper.Token) bool, threshold float32) string {
+	var sb strings.Builder
+	uncertain := false
+	for _, token := range tokens {
+		if !isText(token) {
+			continue
+		}
+		if strings.HasPrefix(token.Text, " ") && uncertain {
+			sb.WriteString(uncertainMarker)
+			uncertain = false
+		}
+		sb.WriteString(token.Text)
+		if token.P < threshold {
+			uncertain = true
+		}
+	}
+	if uncertain {
+		sb.WriteString(uncertainMarker)
+	}
+	return sb.String()
+}
+
+// Counts the words in the transcript, leaving out markers and stray
+// punctuation that have no letters or digits
+func wordCount(transcript string) int {
+	count := 0
+	for _, word := range strings.Fields(transcript) {
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			count++
+		}
+	}
+	return count
+}
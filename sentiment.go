@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words that count towards a positive or negative mood. This is deliberately
+// small: it only has to tell a good day from a bad one at a glance.
+var sentimentWords = map[string]int{
+	"good": 1, "great": 1, "happy": 1, "glad": 1, "love": 1, "loved": 1,
+	"excited": 1, "fun": 1, "nice": 1, "wonderful": 1, "amazing": 1,
+	"awesome": 1, "grateful": 1, "thankful": 1, "proud": 1, "relaxed": 1,
+	"calm": 1, "enjoyed": 1, "beautiful": 1, "better": 1, "best": 1,
+	"bad": -1, "sad": -1, "angry": -1, "upset": -1, "tired": -1,
+	"stressed": -1, "anxious": -1, "worried": -1, "awful": -1,
+	"terrible": -1, "hate": -1, "hated": -1, "frustrated": -1,
+	"annoyed": -1, "lonely": -1, "sick": -1, "hurt": -1, "worse": -1,
+	"worst": -1, "exhausted": -1, "disappointed": -1,
+}
+
+// Words that flip the sentiment of the word right after them, as in "not good"
+var negations = map[string]bool{
+	"not": true, "no": true, "never": true, "don't": true, "didn't": true,
+	"isn't": true, "wasn't": true, "wouldn't": true,
+}
+
+// Scores the transcript by counting positive and negative words
+func sentimentScore(transcript string) int {
+	words := strings.FieldsFunc(strings.ToLower(transcript), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	score := 0
+	for i, word := range words {
+		value := sentimentWords[word]
+		if value != 0 && i > 0 && negations[words[i-1]] {
+			value = -value
+		}
+		score += value
+	}
+	return score
+}
+
+func sentimentEmoji(transcript string) string {
+	switch score := sentimentScore(transcript); {
+	case score > 0:
+		return "🙂"
+	case score < 0:
+		return "🙁"
+	default:
+		return "😐"
+	}
+}
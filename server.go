@@ -3,13 +3,27 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/caarlos0/env"
 	"github.com/dstotijn/go-notion"
@@ -29,18 +43,438 @@ const (
 	whisperNumChans = 1
 	// Url path for recording callback
 	recordingPath = "/recording"
+	// Url path for the action requested when a recording ends
+	recordedPath = "/recorded"
+	// Url path for Twilio's transcription callback
+	transcriptionPath = "/transcription"
 	// Maximum length of title string used in Notion
 	maxTitleLen = 32
+	// Gin context key for the parsed form of a Twilio callback
+	twilioFormKey = "twilioForm"
+	// Prefix for the titles of entries with low transcription confidence
+	lowConfidenceFlag = "⚠️ "
+	// Appended to the transcripts of entries that were truncated by a
+	// transcription error
+	truncatedMarker = "[transcript truncated]"
+	// Labels for the channels of a dual-channel recording when speakers are
+	// separated. Twilio records the caller on the first channel.
+	speakerLabels = "AB"
+	// How long shutdown waits for requests in progress to finish
+	shutdownTimeout = 10 * time.Second
+	// How long shutdown then waits for queued recordings to be processed
+	queueDrainTimeout = time.Minute
+	// Twilio console page for a call, given its CallSid
+	twilioCallLogUrl = "https://console.twilio.com/us1/monitor/logs/calls/"
+	// Maximum length of a single rich text object in Notion
+	maxRichTextLen = 2000
+	// Maximum number of blocks Notion accepts in a single request
+	maxChildBlocks = 100
+	// Default length of the chunks recordings are transcribed in. Whisper
+	// works in 30 second windows regardless, so this only bounds memory, but
+	// words can be cut at chunk boundaries.
+	defaultChunkSeconds = 300
 )
 
 type config struct {
-	ModelFile        string   `env:"MODEL_FILE,required"`
-	ExternalHostname string   `env:"EXTERNAL_HOSTNAME,required"`
-	CallerWhitelist  []string `env:"CALLER_WHITELIST,required"`
-	TwilioAccountSid string   `env:"TWILIO_ACCOUNT_SID,required"`
-	TwilioAuthToken  string   `env:"TWILIO_AUTH_TOKEN,required"`
-	NotionAuthToken  string   `env:"NOTION_AUTH_TOKEN,required"`
-	NotionDatabaseId string   `env:"NOTION_DATABASE_ID,required"`
+	ModelFile        string     `env:"MODEL_FILE"`
+	ModelWarmup      bool       `env:"MODEL_WARMUP" envDefault:"true"`
+	ExternalHostname string     `env:"EXTERNAL_HOSTNAME,required"`
+	CallerWhitelist  []string   `env:"CALLER_WHITELIST"`
+	TwilioAccountSid string     `env:"TWILIO_ACCOUNT_SID,required"`
+	TwilioAuthToken  string     `env:"TWILIO_AUTH_TOKEN,required"`
+	RecordingKey     privateKey `env:"RECORDING_PRIVATE_KEY"`
+	NotionAuthToken  string     `env:"NOTION_AUTH_TOKEN"`
+	NotionDatabaseId string     `env:"NOTION_DATABASE_ID"`
+	NotionPageId     string     `env:"NOTION_PAGE_ID"`
+	NotionParentType string     `env:"NOTION_PARENT_TYPE" envDefault:"database"`
+	FfmpegPath       string     `env:"FFMPEG_PATH"`
+	ResampleQuality  int        `env:"RESAMPLE_QUALITY" envDefault:"3"`
+	AudioNormalize   bool       `env:"AUDIO_NORMALIZE"`
+	ChunkSeconds     int        `env:"TRANSCRIBE_CHUNK_SECONDS"`
+	StoreBackends    []string   `env:"STORE_BACKEND" envDefault:"notion"`
+	MarkdownDir      string     `env:"MARKDOWN_DIR"`
+	SQLitePath       string     `env:"SQLITE_PATH"`
+	TrustedProxies   []string   `env:"TRUSTED_PROXIES"`
+	TrustedPlatform  string     `env:"TRUSTED_PLATFORM" envDefault:"cloudflare"`
+	CancelKey        string     `env:"CANCEL_KEY"`
+
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+
+	TwilioRelaxedHost bool `env:"TWILIO_RELAXED_HOST"`
+
+	WhitelistDisabled bool `env:"WHITELIST_DISABLED"`
+
+	ArchiveBucket          string `env:"ARCHIVE_BUCKET"`
+	ArchiveEndpoint        string `env:"ARCHIVE_ENDPOINT" envDefault:"s3.amazonaws.com"`
+	ArchiveRegion          string `env:"ARCHIVE_REGION"`
+	ArchiveAccessKeyId     string `env:"ARCHIVE_ACCESS_KEY_ID"`
+	ArchiveSecretAccessKey string `env:"ARCHIVE_SECRET_ACCESS_KEY"`
+
+	AdminSecret string `env:"ADMIN_SECRET"`
+	QueueSize   int    `env:"QUEUE_SIZE" envDefault:"16"`
+	WorkerCount int    `env:"WORKER_COUNT" envDefault:"1"`
+	FailedDir   string `env:"FAILED_DIR"`
+
+	MaxUploadBytes int64 `env:"MAX_UPLOAD_BYTES" envDefault:"52428800"`
+
+	HTTPTimeout time.Duration `env:"HTTP_TIMEOUT" envDefault:"2m"`
+
+	AdminSigningKey string `env:"ADMIN_SIGNING_KEY"`
+
+	ModelInstances int `env:"MODEL_INSTANCES" envDefault:"1"`
+
+	WhisperParallelism         int  `env:"WHISPER_PARALLELISM" envDefault:"1"`
+	WhisperMaxTokensPerSegment uint `env:"WHISPER_MAX_TOKENS_PER_SEGMENT"`
+	WhisperSpeedUp             bool `env:"WHISPER_SPEED_UP"`
+
+	DebugAudioDir      string `env:"DEBUG_AUDIO_DIR"`
+	DebugAudioMaxBytes int64  `env:"DEBUG_AUDIO_MAX_BYTES" envDefault:"524288000"`
+
+	PersistRawAudio       bool          `env:"PERSIST_RAW_AUDIO"`
+	RawAudioDir           string        `env:"RAW_AUDIO_DIR"`
+	RawAudioRetryInterval time.Duration `env:"RAW_AUDIO_RETRY_INTERVAL" envDefault:"15m"`
+
+	DedupTTL  time.Duration `env:"DEDUP_TTL" envDefault:"24h"`
+	DedupFile string        `env:"DEDUP_FILE"`
+
+	Language          string    `env:"LANGUAGE"`
+	CallerLanguageMap callerMap `env:"CALLER_LANGUAGE_MAP"`
+	CallerNameMap     callerMap `env:"CALLER_NAME_MAP"`
+
+	LanguageDetectModel string `env:"LANGUAGE_DETECT_MODEL"`
+	TranslateToEnglish  bool   `env:"TRANSLATE_TO_ENGLISH"`
+
+	InitialPrompt string   `env:"INITIAL_PROMPT"`
+	Vocabulary    []string `env:"VOCABULARY"`
+
+	MinConfidence      float64 `env:"MIN_CONFIDENCE"`
+	NotionFlagProperty string  `env:"NOTION_FLAG_PROPERTY"`
+
+	IncludeAlternatives bool    `env:"INCLUDE_ALTERNATIVES"`
+	AltConfidence       float64 `env:"ALT_CONFIDENCE" envDefault:"0.5"`
+
+	DatePhrases   []string `env:"DATE_PHRASES"`
+	DeletePhrase  string   `env:"DELETE_PHRASE"`
+	SplitPhrase   string   `env:"SPLIT_PHRASE"`
+	GreetWithLast bool     `env:"GREET_WITH_LAST_ENTRY"`
+	BodyHeader    bool     `env:"BODY_HEADER"`
+	BodyDivider   bool     `env:"BODY_DIVIDER"`
+	BodyBlock     string   `env:"NOTION_BODY_BLOCK" envDefault:"paragraph"`
+
+	NotionSentimentIcon bool `env:"NOTION_SENTIMENT_ICON"`
+
+	CallerCoverMap     callerMap `env:"CALLER_COVER_MAP"`
+	NotionDefaultCover string    `env:"NOTION_DEFAULT_COVER"`
+
+	NotionMaxRetries   int           `env:"NOTION_MAX_RETRIES" envDefault:"3"`
+	NotionMaxRetryWait time.Duration `env:"NOTION_MAX_RETRY_WAIT" envDefault:"1m"`
+
+	NotionCallProperty string `env:"NOTION_CALL_PROPERTY"`
+	NotionCallLink     bool   `env:"NOTION_CALL_LINK"`
+
+	SessionWindow time.Duration `env:"SESSION_WINDOW"`
+
+	NotionPlaceholder bool `env:"NOTION_PLACEHOLDER"`
+
+	DeleteTwilioRecording bool `env:"DELETE_TWILIO_RECORDING"`
+
+	DefaultTitle string `env:"DEFAULT_TITLE"`
+
+	TitlePhrase string `env:"TITLE_PHRASE"`
+
+	NotionRelationProperty string `env:"NOTION_RELATION_PROPERTY"`
+	NotionRelationDefault  string `env:"NOTION_RELATION_DEFAULT"`
+	NotionRelationDatabase string `env:"NOTION_RELATION_DATABASE"`
+	RelationPhrase         string `env:"RELATION_PHRASE"`
+
+	FirstTimePrompt string `env:"FIRST_TIME_PROMPT"`
+
+	NotionLanguageProperty string `env:"NOTION_LANGUAGE_PROPERTY"`
+
+	GroupBy             string `env:"GROUP_BY" envDefault:"none"`
+	NotionGroupProperty string `env:"NOTION_GROUP_PROPERTY" envDefault:"Group"`
+
+	Transcriber string `env:"TRANSCRIBER" envDefault:"whisper"`
+
+	FallbackTranscriber string        `env:"FALLBACK_TRANSCRIBER"`
+	TranscribeTimeout   time.Duration `env:"TRANSCRIBE_TIMEOUT"`
+
+	OpenAIApiKey string `env:"OPENAI_API_KEY"`
+	OpenAIModel  string `env:"OPENAI_MODEL" envDefault:"whisper-1"`
+	OpenAIUrl    string `env:"OPENAI_URL" envDefault:"https://api.openai.com/v1/audio/transcriptions"`
+
+	DeepgramApiKey      string `env:"DEEPGRAM_API_KEY"`
+	DeepgramModel       string `env:"DEEPGRAM_MODEL" envDefault:"nova-2"`
+	DeepgramSmartFormat bool   `env:"DEEPGRAM_SMART_FORMAT" envDefault:"true"`
+	DeepgramPunctuate   bool   `env:"DEEPGRAM_PUNCTUATE" envDefault:"true"`
+	DeepgramFromTwilio  bool   `env:"DEEPGRAM_FROM_TWILIO"`
+
+	GcpModel        string `env:"GCP_SPEECH_MODEL" envDefault:"phone_call"`
+	GcpLanguageCode string `env:"GCP_LANGUAGE_CODE" envDefault:"en-US"`
+	GcpPunctuation  bool   `env:"GCP_AUTOMATIC_PUNCTUATION" envDefault:"true"`
+
+	AzureSpeechKey    string `env:"AZURE_SPEECH_KEY"`
+	AzureSpeechRegion string `env:"AZURE_SPEECH_REGION"`
+	AzureSpeechLocale string `env:"AZURE_SPEECH_LOCALE" envDefault:"en-US"`
+	AzureConversation bool   `env:"AZURE_CONVERSATION_TRANSCRIPTION"`
+
+	VoskUrl string `env:"VOSK_URL"`
+
+	SpeakerSeparation bool `env:"SPEAKER_SEPARATION"`
+
+	DiarizationUrl string `env:"DIARIZATION_URL"`
+
+	TwilioTranscribe bool `env:"TWILIO_TRANSCRIBE"`
+
+	PostprocessCapitalize bool `env:"POSTPROCESS_CAPITALIZE"`
+
+	Redact         bool      `env:"REDACT"`
+	RedactPatterns []pattern `env:"REDACT_PATTERNS" envSeparator:";"`
+
+	MaskProfanity  bool     `env:"MASK_PROFANITY"`
+	ProfanityWords []string `env:"PROFANITY_WORDS"`
+
+	RemoveFillers             bool     `env:"REMOVE_FILLERS"`
+	FillerWords               []string `env:"FILLER_WORDS"`
+	ArchiveOriginalTranscript bool     `env:"ARCHIVE_ORIGINAL_TRANSCRIPT"`
+
+	Timezone         timezone `env:"TIMEZONE" envDefault:"Local"`
+	Locale           locale   `env:"LOCALE" envDefault:"en"`
+	DailySummaryTime string   `env:"DAILY_SUMMARY_TIME"`
+
+	AllowedHours hourRange `env:"ALLOWED_HOURS"`
+
+	CallerNotionConfig notionTargets `env:"CALLER_NOTION_CONFIG"`
+
+	MinRecordingSeconds float64 `env:"MIN_RECORDING_SECONDS"`
+
+	MinWords int `env:"MIN_WORDS"`
+
+	TranscriptWebhook        string        `env:"TRANSCRIPT_WEBHOOK"`
+	TranscriptWebhookTimeout time.Duration `env:"TRANSCRIPT_WEBHOOK_TIMEOUT" envDefault:"10s"`
+
+	NotionStatusProperty string `env:"NOTION_STATUS_PROPERTY"`
+	NotionStatusValue    string `env:"NOTION_STATUS_VALUE"`
+	NotionStatusType     string `env:"NOTION_STATUS_TYPE" envDefault:"status"`
+}
+
+func (cfg config) validate() error {
+	if len(cfg.CallerWhitelist) == 0 && !cfg.WhitelistDisabled {
+		return errors.New("CALLER_WHITELIST must contain at least one number unless WHITELIST_DISABLED is set")
+	}
+	for _, backend := range cfg.StoreBackends {
+		switch backend {
+		case "notion":
+			if err := cfg.validateNotion(); err != nil {
+				return err
+			}
+		case "markdown":
+			if cfg.MarkdownDir == "" {
+				return errors.New("MARKDOWN_DIR is required for markdown backend")
+			}
+		default:
+			return fmt.Errorf("unsupported store backend: %q", backend)
+		}
+	}
+	transcribers := []string{cfg.Transcriber}
+	if cfg.FallbackTranscriber != "" {
+		if cfg.FallbackTranscriber == cfg.Transcriber {
+			return errors.New("FALLBACK_TRANSCRIBER must differ from TRANSCRIBER")
+		}
+		if cfg.FallbackTranscriber == "whisper" {
+			// The model would hold up every recording while it loads
+			return errors.New("FALLBACK_TRANSCRIBER can't be whisper")
+		}
+		transcribers = append(transcribers, cfg.FallbackTranscriber)
+	}
+	for _, name := range transcribers {
+		switch name {
+		case "whisper":
+			if cfg.ModelFile == "" {
+				return errors.New("MODEL_FILE is required for whisper transcriber")
+			}
+		case "openai":
+			if cfg.OpenAIApiKey == "" {
+				return errors.New("OPENAI_API_KEY is required for openai transcriber")
+			}
+		case "deepgram":
+			if cfg.DeepgramApiKey == "" {
+				return errors.New("DEEPGRAM_API_KEY is required for deepgram transcriber")
+			}
+		case "gcp":
+		case "azure":
+			if cfg.AzureSpeechKey == "" || cfg.AzureSpeechRegion == "" {
+				return errors.New("AZURE_SPEECH_KEY and AZURE_SPEECH_REGION are required for azure transcriber")
+			}
+		case "vosk":
+			if cfg.VoskUrl == "" {
+				return errors.New("VOSK_URL is required for vosk transcriber")
+			}
+		default:
+			return fmt.Errorf("unsupported transcriber: %q", name)
+		}
+	}
+	// The pinned whisper bindings keep a context's params private, so
+	// there's no passing whisper a prompt without forking them
+	if cfg.InitialPrompt != "" && cfg.Transcriber != "openai" && cfg.FallbackTranscriber != "openai" {
+		return errors.New("INITIAL_PROMPT is only used by the openai transcriber")
+	}
+	if cfg.TranslateToEnglish && cfg.Transcriber != "whisper" {
+		return errors.New("TRANSLATE_TO_ENGLISH requires the whisper transcriber")
+	}
+	// Whisper reports the language it was given rather than the one it
+	// heard, so without one of these every recording looks like English
+	if cfg.TranslateToEnglish && cfg.Language == "" && len(cfg.CallerLanguageMap) == 0 && cfg.LanguageDetectModel == "" {
+		return errors.New("TRANSLATE_TO_ENGLISH requires LANGUAGE, CALLER_LANGUAGE_MAP or LANGUAGE_DETECT_MODEL")
+	}
+	switch cfg.GroupBy {
+	case "day", "week", "month", "none":
+	default:
+		return fmt.Errorf("unsupported grouping: %q", cfg.GroupBy)
+	}
+	switch cfg.BodyBlock {
+	case "paragraph", "toggle", "callout":
+	default:
+		return fmt.Errorf("unsupported notion body block: %q", cfg.BodyBlock)
+	}
+	if cfg.NotionStatusType != "status" && cfg.NotionStatusType != "select" {
+		return fmt.Errorf("unsupported notion status type: %q", cfg.NotionStatusType)
+	}
+	if cfg.ArchiveBucket != "" && (cfg.ArchiveAccessKeyId == "" || cfg.ArchiveSecretAccessKey == "") {
+		return errors.New("ARCHIVE_ACCESS_KEY_ID and ARCHIVE_SECRET_ACCESS_KEY are required for archival")
+	}
+	for _, cover := range append(cfg.CallerCoverMap.values(), cfg.NotionDefaultCover) {
+		if cover == "" {
+			continue
+		}
+		u, err := url.Parse(cover)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("invalid cover image url: %q", cover)
+		}
+	}
+	if cfg.ArchiveOriginalTranscript && cfg.ArchiveBucket == "" {
+		return errors.New("ARCHIVE_ORIGINAL_TRANSCRIPT requires ARCHIVE_BUCKET")
+	}
+	if cfg.DailySummaryTime != "" {
+		if _, err := time.Parse("15:04", cfg.DailySummaryTime); err != nil {
+			return errors.Wrap(err, "parse DAILY_SUMMARY_TIME failed")
+		}
+		if !cfg.usesStore("notion") || cfg.NotionParentType != "database" {
+			return errors.New("daily summaries require a notion database parent")
+		}
+	}
+	if len(cfg.CancelKey) > 1 || (cfg.CancelKey != "" && !strings.Contains("0123456789*#", cfg.CancelKey)) {
+		return fmt.Errorf("CANCEL_KEY must be a single key, got %q", cfg.CancelKey)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.ResampleQuality < 1 || cfg.ResampleQuality > 64 {
+		return fmt.Errorf("RESAMPLE_QUALITY must be between 1 and 64, got %d", cfg.ResampleQuality)
+	}
+	if cfg.MaxUploadBytes <= 0 {
+		return fmt.Errorf("MAX_UPLOAD_BYTES must be positive, got %d", cfg.MaxUploadBytes)
+	}
+	if cfg.HTTPTimeout <= 0 {
+		return fmt.Errorf("HTTP_TIMEOUT must be positive, got %v", cfg.HTTPTimeout)
+	}
+	if cfg.NotionMaxRetries < 0 {
+		return fmt.Errorf("NOTION_MAX_RETRIES must not be negative, got %d", cfg.NotionMaxRetries)
+	}
+	if cfg.SpeakerSeparation && cfg.FfmpegPath == "" {
+		return errors.New("SPEAKER_SEPARATION requires FFMPEG_PATH")
+	}
+	if cfg.SessionWindow < 0 {
+		return fmt.Errorf("SESSION_WINDOW must not be negative, got %v", cfg.SessionWindow)
+	}
+	if cfg.SessionWindow > 0 && !cfg.usesStore("notion") {
+		return errors.New("SESSION_WINDOW requires the notion backend")
+	}
+	if cfg.NotionPlaceholder && !cfg.usesStore("notion") {
+		return errors.New("NOTION_PLACEHOLDER requires the notion backend")
+	}
+	if cfg.DebugAudioDir != "" && cfg.DebugAudioMaxBytes <= 0 {
+		return fmt.Errorf("DEBUG_AUDIO_MAX_BYTES must be positive, got %d", cfg.DebugAudioMaxBytes)
+	}
+	if cfg.PersistRawAudio && (cfg.RawAudioDir == "" || cfg.FailedDir == "") {
+		return errors.New("PERSIST_RAW_AUDIO requires RAW_AUDIO_DIR and FAILED_DIR")
+	}
+	if cfg.PersistRawAudio && cfg.RawAudioRetryInterval <= 0 {
+		return fmt.Errorf("RAW_AUDIO_RETRY_INTERVAL must be positive, got %v", cfg.RawAudioRetryInterval)
+	}
+	if cfg.DedupTTL < 0 {
+		return fmt.Errorf("DEDUP_TTL must not be negative, got %v", cfg.DedupTTL)
+	}
+	if cfg.ChunkSeconds < 0 {
+		return fmt.Errorf("TRANSCRIBE_CHUNK_SECONDS must not be negative, got %d", cfg.ChunkSeconds)
+	}
+	if cfg.NotionRelationProperty != "" && (!cfg.usesStore("notion") || cfg.NotionParentType != "database") {
+		return errors.New("NOTION_RELATION_PROPERTY requires a notion database parent")
+	}
+	if cfg.RelationPhrase != "" && cfg.NotionRelationProperty == "" {
+		return errors.New("RELATION_PHRASE requires NOTION_RELATION_PROPERTY")
+	}
+	if cfg.DeletePhrase != "" {
+		if !cfg.usesStore("notion") {
+			return errors.New("DELETE_PHRASE requires the notion backend")
+		}
+		if err := cfg.validateOwnedTargets("DELETE_PHRASE"); err != nil {
+			return err
+		}
+	}
+	// Without the index, the last entry can only be looked up in a Notion
+	// target the caller owns
+	if cfg.GreetWithLast && cfg.SQLitePath == "" {
+		if !cfg.usesStore("notion") {
+			return errors.New("GREET_WITH_LAST_ENTRY requires SQLITE_PATH or the notion backend")
+		}
+		if err := cfg.validateOwnedTargets("GREET_WITH_LAST_ENTRY without SQLITE_PATH"); err != nil {
+			return err
+		}
+	}
+	if cfg.MinWords < 0 {
+		return fmt.Errorf("MIN_WORDS must not be negative, got %d", cfg.MinWords)
+	}
+	if cfg.MinRecordingSeconds < 0 {
+		return fmt.Errorf("MIN_RECORDING_SECONDS must not be negative, got %v", cfg.MinRecordingSeconds)
+	}
+	if cfg.MinConfidence < 0 || cfg.MinConfidence > 1 {
+		return fmt.Errorf("MIN_CONFIDENCE must be between 0 and 1, got %v", cfg.MinConfidence)
+	}
+	if cfg.AltConfidence < 0 || cfg.AltConfidence > 1 {
+		return fmt.Errorf("ALT_CONFIDENCE must be between 0 and 1, got %v", cfg.AltConfidence)
+	}
+	if cfg.QueueSize < 0 || cfg.WorkerCount < 1 {
+		return fmt.Errorf("invalid queue size %d or worker count %d", cfg.QueueSize, cfg.WorkerCount)
+	}
+	if cfg.ModelInstances < 1 {
+		return fmt.Errorf("MODEL_INSTANCES must be at least 1, got %d", cfg.ModelInstances)
+	}
+	// Each chunk transcribed at once needs a model instance of its own
+	if cfg.WhisperParallelism < 1 || cfg.WhisperParallelism > cfg.ModelInstances {
+		return fmt.Errorf("WHISPER_PARALLELISM must be between 1 and MODEL_INSTANCES (%d), got %d", cfg.ModelInstances, cfg.WhisperParallelism)
+	}
+	return nil
+}
+
+func (cfg config) validateNotion() error {
+	if cfg.NotionAuthToken == "" {
+		return errors.New("NOTION_AUTH_TOKEN is required for notion backend")
+	}
+	switch cfg.NotionParentType {
+	case "database":
+		if cfg.NotionDatabaseId == "" {
+			return errors.New("NOTION_DATABASE_ID is required for database parent")
+		}
+	case "page":
+		if cfg.NotionPageId == "" {
+			return errors.New("NOTION_PAGE_ID is required for page parent")
+		}
+	default:
+		return fmt.Errorf("unsupported notion parent type: %q", cfg.NotionParentType)
+	}
+	return nil
 }
 
 func main() {
@@ -48,28 +482,628 @@ func main() {
 	if err := env.Parse(&cfg); err != nil {
 		log.Fatal(err)
 	}
+	cfg.CallerWhitelist = sanitizeCallerWhitelist(cfg.CallerWhitelist)
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.FfmpegPath != "" {
+		if _, err := exec.LookPath(cfg.FfmpegPath); err != nil {
+			logf(context.Background(), "ffmpeg not usable, falling back to native decoder: %v", err)
+		}
+	}
+
+	// The model loads in the background once everything else is set up.
+	// Hosted transcribers don't need one.
+	var models *modelHolder
+	if cfg.Transcriber == "whisper" {
+		logf(context.Background(), "Compute backend: %s", computeBackend())
+		models = newModelHolder(cfg.ModelInstances)
+		if cfg.WorkerCount*cfg.WhisperParallelism < cfg.ModelInstances {
+			logf(context.Background(), "WARNING: WORKER_COUNT (%d) times WHISPER_PARALLELISM (%d) is less than MODEL_INSTANCES (%d), so some instances will sit idle.", cfg.WorkerCount, cfg.WhisperParallelism, cfg.ModelInstances)
+		}
+		defer models.Close()
+	}
+
+	var archiver *archiver
+	if cfg.ArchiveBucket != "" {
+		var err error
+		archiver, err = newArchiver(cfg)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "create archiver failed"))
+		}
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	model, err := whisper.New(cfg.ModelFile)
+	var index *sqliteStore
+	if cfg.SQLitePath != "" {
+		index, err = newSQLiteStore(cfg.SQLitePath, cfg.DefaultTitle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer index.Close()
+	}
+
+	var failed *failedStore
+	if cfg.FailedDir != "" {
+		failed, err = newFailedStore(cfg.FailedDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var dedup *recordingDedup
+	if cfg.DedupTTL > 0 {
+		dedup, err = newRecordingDedup(cfg.DedupFile, cfg.DedupTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var raw *rawAudioStore
+	if cfg.PersistRawAudio {
+		raw, err = newRawAudioStore(cfg.RawAudioDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	transcriber, err := newTranscriber(cfg, models)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "create whisper model failed"))
+		log.Fatal(err)
 	}
-	defer model.Close()
 
-	router := gin.Default()
-	router.SetTrustedProxies(nil)
-	router.TrustedPlatform = gin.PlatformCloudflare
+	p := &pipeline{
+		cfg:         cfg,
+		models:      models,
+		transcriber: transcriber,
+		archiver:    archiver,
+		store:       store,
+		index:       index,
+		failed:      failed,
+		raw:         raw,
+	}
+	queue := newWorkQueue(cfg.QueueSize, cfg.WorkerCount)
+	if raw != nil {
+		go p.retrySavedAudio(queue, cfg.RawAudioRetryInterval)
+	}
+
+	if models != nil {
+		go func() {
+			if err := models.reload(cfg.ModelFile); err != nil {
+				if cfg.FallbackTranscriber == "" {
+					log.Fatal(err)
+				}
+				logf(context.Background(), "load model failed, transcribing with %s: %v", cfg.FallbackTranscriber, err)
+				models.giveUp()
+			} else {
+				logf(context.Background(), "Loaded model %s", models.info())
+				if cfg.ModelWarmup {
+					if err := models.warmUp(); err != nil {
+						logf(context.Background(), "warm up model failed: %v", err)
+					}
+				}
+			}
+			if failed != nil {
+				p.retryWaiting(queue)
+			}
+		}()
+	}
+
+	if cfg.DailySummaryTime != "" {
+		at, _ := time.Parse("15:04", cfg.DailySummaryTime)
+		go runDailySummaries(cfg, at)
+	}
+
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "parse trusted proxies failed"))
+	}
+
+	router := gin.New()
+	router.Use(accessLogger(), gin.Recovery())
+	router.SetTrustedProxies(cfg.TrustedProxies)
+	router.TrustedPlatform = trustedPlatformHeader(cfg.TrustedPlatform)
 
 	requestValidator := client.NewRequestValidator(cfg.TwilioAuthToken)
-	signatureChecker := checkTwilioSignature(&requestValidator, cfg.ExternalHostname)
-	whitelistChecker := checkCallerWhitelist(cfg.CallerWhitelist)
+	signatureChecker := checkTwilioSignature(&requestValidator, cfg.ExternalHostname, cfg.TwilioRelaxedHost, trustedProxies)
+	whitelistChecker := checkCallerWhitelist(cfg.CallerWhitelist, cfg.WhitelistDisabled)
+	if cfg.WhitelistDisabled {
+		logf(context.Background(), "WARNING: WHITELIST_DISABLED is set, calls from any number will be recorded. Unset it once setup is done.")
+	}
+
+	// Twilio's callbacks are signed form posts from whitelisted callers
+	twilio := router.Group("/", parseTwilioForm(), signatureChecker, whitelistChecker)
+
+	twilio.POST("/call", callHandler(cfg, index))
+
+	cancelled := newCancelledCalls()
+	var failedRecordings, absentRecordings atomic.Int64
+
+	twilio.POST(recordedPath, recordedHandler(cfg, cancelled))
+
+	twilio.POST(recordingPath, func(c *gin.Context) {
+		form := twilioForm(c)
+		status := form.Get("RecordingStatus")
+		switch status {
+		case "completed":
+		case "failed", "absent":
+			// The call happened but there's nothing to transcribe, either
+			// because Twilio couldn't save the recording or because the
+			// caller didn't say anything
+			if status == "failed" {
+				failedRecordings.Add(1)
+			} else {
+				absentRecordings.Add(1)
+			}
+			logf(c.Request.Context(), "Recording %s: %s", status, form.Get("RecordingSid"))
+			c.String(http.StatusOK, "Thanks!")
+			return
+		case "in-progress":
+			c.String(http.StatusOK, "Thanks!")
+			return
+		default:
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unexpected recording status: %q", status))
+			return
+		}
+
+		rec := recording{
+			Url:        form.Get("RecordingUrl"),
+			Sid:        form.Get("RecordingSid"),
+			Caller:     form.Get("From"),
+			CallSid:    form.Get("CallSid"),
+			Encryption: form.Get("EncryptionDetails"),
+		}
+		if channels, err := strconv.Atoi(form.Get("RecordingChannels")); err == nil {
+			rec.Channels = channels
+		}
+		if seconds, err := strconv.Atoi(form.Get("RecordingDuration")); err == nil {
+			rec.Duration = time.Duration(seconds) * time.Second
+		}
+		if rec.Duration > 0 && rec.Duration.Seconds() < cfg.MinRecordingSeconds {
+			logf(c.Request.Context(), "Skipping recording shorter than minimum: %s (%v)", rec.Sid, rec.Duration)
+			c.String(http.StatusOK, "Thanks!")
+			return
+		}
+
+		callSid := rec.CallSid
+		if cancelled.has(callSid) {
+			logf(c.Request.Context(), "Skipping cancelled recording: %s", rec.Sid)
+			c.String(http.StatusOK, "Thanks!")
+			return
+		}
+		if dedup != nil {
+			added, err := dedup.add(rec.Sid)
+			if err != nil {
+				logf(c.Request.Context(), "save dedup file failed: %v", err)
+			}
+			if !added {
+				logf(c.Request.Context(), "Skipping duplicate recording: %s", rec.Sid)
+				c.String(http.StatusOK, "Thanks!")
+				return
+			}
+		}
+
+		ctx := withCallSid(detachedContext(c), callSid)
+		if cfg.NotionPlaceholder && queue.depth() < queue.capacity() {
+			id, err := createPlaceholder(ctx, cfg, rec.Caller, time.Now().In(cfg.Timezone.loc()))
+			if err != nil {
+				// The entry still gets a page of its own once it's ready
+				logf(ctx, "create placeholder failed: %v", err)
+			}
+			rec.PlaceholderPageId = id
+		}
+		enqueued := queue.tryEnqueue(func() {
+			// The status callback can beat the record action, so check
+			// again once the recording reaches the front of the queue
+			if cancelled.has(callSid) {
+				logf(ctx, "Skipping cancelled recording: %s", rec.Sid)
+				discardPlaceholder(ctx, cfg, rec)
+				return
+			}
+			p.processRecording(ctx, rec)
+		})
+		if !enqueued {
+			logf(c.Request.Context(), "Queue full, dropping recording: %s", rec.Sid)
+			discardPlaceholder(ctx, cfg, rec)
+			if dedup != nil {
+				// Let Twilio's retry through
+				if err := dedup.remove(rec.Sid); err != nil {
+					logf(c.Request.Context(), "save dedup file failed: %v", err)
+				}
+			}
+			c.String(http.StatusTooManyRequests, "Busy, try again later")
+			return
+		}
+		c.String(http.StatusOK, "Thanks!")
+	})
+
+	// Twilio's own transcription, when TWILIO_TRANSCRIBE is set. The
+	// transcript skips straight to the steps after transcription.
+	twilio.POST(transcriptionPath, func(c *gin.Context) {
+		form := twilioForm(c)
+		switch status := form.Get("TranscriptionStatus"); status {
+		case "completed":
+		case "failed":
+			logf(c.Request.Context(), "Twilio transcription failed: %s", form.Get("RecordingSid"))
+			c.String(http.StatusOK, "Thanks!")
+			return
+		default:
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unexpected transcription status: %q", status))
+			return
+		}
 
-	router.POST("/call", signatureChecker, whitelistChecker, func(c *gin.Context) {
-		say := &twiml.VoiceSay{
-			Message: "What's on your mind? This call is recorded.",
+		rec := recording{
+			Url:              form.Get("RecordingUrl"),
+			Sid:              form.Get("RecordingSid"),
+			Caller:           form.Get("From"),
+			CallSid:          form.Get("CallSid"),
+			TwilioTranscript: form.Get("TranscriptionText"),
+		}
+		if strings.TrimSpace(rec.TwilioTranscript) == "" {
+			logf(c.Request.Context(), "Skipping empty Twilio transcription: %s", rec.Sid)
+			c.String(http.StatusOK, "Thanks!")
+			return
+		}
+		if cancelled.has(rec.CallSid) {
+			logf(c.Request.Context(), "Skipping cancelled recording: %s", rec.Sid)
+			c.String(http.StatusOK, "Thanks!")
+			return
+		}
+		if dedup != nil {
+			added, err := dedup.add(rec.Sid)
+			if err != nil {
+				logf(c.Request.Context(), "save dedup file failed: %v", err)
+			}
+			if !added {
+				logf(c.Request.Context(), "Skipping duplicate recording: %s", rec.Sid)
+				c.String(http.StatusOK, "Thanks!")
+				return
+			}
 		}
+
+		ctx := withCallSid(detachedContext(c), rec.CallSid)
+		if !queue.tryEnqueue(func() { p.processRecording(ctx, rec) }) {
+			logf(c.Request.Context(), "Queue full, dropping transcription: %s", rec.Sid)
+			if dedup != nil {
+				if err := dedup.remove(rec.Sid); err != nil {
+					logf(c.Request.Context(), "save dedup file failed: %v", err)
+				}
+			}
+			c.String(http.StatusTooManyRequests, "Busy, try again later")
+			return
+		}
+		c.String(http.StatusOK, "Thanks!")
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		if models != nil && !models.ready() {
+			c.String(http.StatusServiceUnavailable, "model loading")
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	})
+
+	router.GET("/metrics", func(c *gin.Context) {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "phone_journal_queue_depth %d\n", queue.depth())
+		fmt.Fprintf(&sb, "phone_journal_queue_capacity %d\n", queue.capacity())
+		fmt.Fprintf(&sb, "phone_journal_recordings_dropped_total %d\n", queue.dropped.Load())
+		fmt.Fprintf(&sb, "phone_journal_recordings_failed_total %d\n", failedRecordings.Load())
+		fmt.Fprintf(&sb, "phone_journal_recordings_absent_total %d\n", absentRecordings.Load())
+		fmt.Fprintf(&sb, "phone_journal_notion_rate_limited_total %d\n", notionRateLimited.Load())
+		c.String(http.StatusOK, sb.String())
+	})
+
+	if cfg.AdminSecret != "" || cfg.AdminSigningKey != "" {
+		adminChecker := checkAdminSecret(cfg.AdminSecret)
+		if cfg.AdminSigningKey != "" {
+			adminChecker = checkAdminSignature(cfg.AdminSigningKey, cfg.MaxUploadBytes)
+		}
+
+		router.POST("/reload-model", adminChecker, func(c *gin.Context) {
+			var req struct {
+				ModelFile string `json:"model_file" binding:"required"`
+			}
+			if models == nil {
+				c.AbortWithError(http.StatusBadRequest, errors.New("transcriber doesn't use a local model"))
+				return
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			if err := models.reload(req.ModelFile); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			logf(c.Request.Context(), "Reloaded model: %s", req.ModelFile)
+			c.JSON(http.StatusOK, gin.H{"model_file": req.ModelFile})
+		})
+
+		// Transcribes audio posted as the request body without uploading it,
+		// for testing. Clients that accept text/event-stream get each segment
+		// as it's transcribed, followed by the full transcript.
+		router.POST("/transcribe", adminChecker, func(c *gin.Context) {
+			ctx := c.Request.Context()
+			// Reject uploads that are too large before reading any of
+			// them, or as soon as they go over when the length isn't known
+			if c.Request.ContentLength > cfg.MaxUploadBytes {
+				c.AbortWithError(http.StatusRequestEntityTooLarge, errors.New("upload too large"))
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxUploadBytes))
+			if _, ok := err.(*http.MaxBytesError); ok {
+				c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+				return
+			} else if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			// Make sure the upload is audio with something in it before
+			// waiting on the model
+			resampled, err := prepareRecording(ctx, cfg, bytes.NewReader(body))
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, errors.Wrap(err, "decode audio failed"))
+				return
+			}
+			if duration, err := wavDuration(resampled); err != nil || duration == 0 {
+				c.AbortWithError(http.StatusBadRequest, errors.New("upload has no audio"))
+				return
+			}
+
+			stream := c.GetHeader("Accept") == "text/event-stream"
+			opts := cfg.transcribeOptions("")
+			opts.Language = c.DefaultQuery("language", opts.Language)
+			if stream {
+				c.Header("Cache-Control", "no-cache")
+				opts.OnSegment = func(segment whisper.Segment) {
+					c.SSEvent("segment", gin.H{
+						"start": segment.Start.Seconds(),
+						"end":   segment.End.Seconds(),
+						"text":  segment.Text,
+					})
+					c.Writer.Flush()
+				}
+			}
+
+			transcript, err := transcriber.Transcribe(ctx, resampled, opts)
+			result := gin.H{
+				"transcript": transcript.Text,
+				"confidence": transcript.Confidence,
+				"language":   transcript.Language,
+			}
+			if _, ok := err.(truncatedError); ok {
+				logf(ctx, "%v", err)
+				result["truncated"] = true
+				err = nil
+			}
+			switch {
+			case err == errModelNotReady && !stream:
+				c.AbortWithError(http.StatusServiceUnavailable, err)
+			case err != nil && stream:
+				c.SSEvent("error", gin.H{"error": err.Error()})
+			case err != nil:
+				c.AbortWithError(http.StatusInternalServerError, err)
+			case stream:
+				c.SSEvent("transcript", result)
+			default:
+				c.JSON(http.StatusOK, result)
+			}
+		})
+
+		router.POST("/reprocess", adminChecker, func(c *gin.Context) {
+			sid := c.Query("sid")
+			if !recordingSidPattern.MatchString(sid) {
+				c.AbortWithError(http.StatusBadRequest, errors.New("invalid recording sid"))
+				return
+			}
+			ctx := c.Request.Context()
+			rec, err := fetchRecording(ctx, cfg, sid)
+			if err != nil {
+				c.AbortWithError(http.StatusBadGateway, err)
+				return
+			}
+			ctx = withCallSid(ctx, rec.CallSid)
+
+			transcript, stage, err := p.run(ctx, rec)
+			if err != nil {
+				logf(ctx, "reprocess %s failed: %v", sid, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"sid": sid, "ok": false, "stage": stage, "error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"sid": sid, "ok": true, "transcript": transcript})
+		})
+
+		router.POST("/maintenance", adminChecker, func(c *gin.Context) {
+			ctx := c.Request.Context()
+			result := gin.H{}
+			if index != nil {
+				pages, err := index.vacuum(ctx)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				result["sqlite_pages_reclaimed"] = pages
+			}
+			if failed != nil {
+				pruned, err := failed.prune()
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				result["failed_files_pruned"] = pruned
+			}
+			logf(ctx, "Maintenance done: %v", result)
+			c.JSON(http.StatusOK, result)
+		})
+
+		if index != nil {
+			router.GET("/search", adminChecker, func(c *gin.Context) {
+				q := c.Query("q")
+				if q == "" {
+					c.AbortWithError(http.StatusBadRequest, errors.New("missing query"))
+					return
+				}
+				results, err := index.search(c.Request.Context(), q)
+				if err != nil {
+					// Most likely a malformed query
+					c.AbortWithError(http.StatusBadRequest, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"count": len(results), "results": results})
+			})
+		}
+
+		if failed != nil {
+			router.GET("/failed", adminChecker, func(c *gin.Context) {
+				entries, err := failed.pending()
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"count": len(entries), "entries": entries})
+			})
+
+			// Retries the entry given by the id query parameter, or every
+			// pending entry if there is none
+			router.POST("/failed/retry", adminChecker, func(c *gin.Context) {
+				var entries []failedEntry
+				if id := c.Query("id"); id != "" {
+					if !failedIdPattern.MatchString(id) {
+						c.AbortWithError(http.StatusBadRequest, errors.New("invalid id"))
+						return
+					}
+					f, err := failed.get(id)
+					if os.IsNotExist(err) {
+						c.AbortWithError(http.StatusNotFound, err)
+						return
+					} else if err != nil {
+						c.AbortWithError(http.StatusInternalServerError, err)
+						return
+					}
+					if f.ResolvedAt != nil {
+						c.AbortWithError(http.StatusConflict, errors.New("entry already resolved"))
+						return
+					}
+					entries = append(entries, f)
+				} else {
+					var err error
+					if entries, err = failed.pending(); err != nil {
+						c.AbortWithError(http.StatusInternalServerError, err)
+						return
+					}
+				}
+
+				ctx := c.Request.Context()
+				succeeded := 0
+				results := make([]gin.H, 0, len(entries))
+				for _, f := range entries {
+					if err := p.retry(ctx, f); err != nil {
+						logf(ctx, "retry failed entry %s failed: %v", f.Id, err)
+						results = append(results, gin.H{"id": f.Id, "ok": false, "error": err.Error()})
+						continue
+					}
+					succeeded++
+					results = append(results, gin.H{"id": f.Id, "ok": true})
+				}
+				c.JSON(http.StatusOK, gin.H{
+					"retried":   len(entries),
+					"succeeded": succeeded,
+					"failed":    len(entries) - succeeded,
+					"results":   results,
+				})
+			})
+		}
+	}
+
+	srv := &http.Server{Addr: ":80", Handler: router}
+	if cfg.TLSCertFile != "" {
+		srv.Addr = ":443"
+	}
+	go func() {
+		var err error
+		if cfg.TLSCertFile != "" {
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	logf(context.Background(), "Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logf(ctx, "shutdown failed: %v", err)
+	}
+	// The summary should cover every recording accepted before shutdown
+	ctx, cancel = context.WithTimeout(context.Background(), queueDrainTimeout)
+	defer cancel()
+	if err := queue.drain(ctx); err != nil {
+		logf(ctx, "drain queue failed, %d recordings left: %v", queue.depth(), err)
+	}
+	stats.log(context.Background())
+}
+
+// Answers a call with a greeting followed by the recording, or turns it away
+// outside ALLOWED_HOURS
+func callHandler(cfg config, index *sqliteStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller := twilioForm(c).Get("From")
+		if !cfg.AllowedHours.contains(time.Now().In(cfg.Timezone.loc())) {
+			logf(c.Request.Context(), "Rejecting call outside allowed hours from %s", caller)
+			twimlResult, err := twiml.Voice([]twiml.Element{
+				&twiml.VoiceSay{Message: "Sorry, the journal isn't taking calls right now. Please call back later."},
+				&twiml.VoiceHangup{},
+			})
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+			} else {
+				c.Header("Content-Type", "text/xml")
+				c.String(http.StatusOK, twimlResult)
+			}
+			return
+		}
+
+		var lastTitle string
+		if cfg.GreetWithLast {
+			lastTitle = lastEntryTitle(c.Request.Context(), cfg, index, caller)
+		}
+		message := greeting(cfg.CallerNameMap[caller], lastTitle)
+		if cfg.FirstTimePrompt != "" && lastTitle == "" && isFirstTimeCaller(c.Request.Context(), cfg, index, caller) {
+			message = firstTimeGreeting(cfg.CallerNameMap[caller], cfg.FirstTimePrompt)
+		}
+		say := &twiml.VoiceSay{Message: message}
 		record := &twiml.VoiceRecord{
 			RecordingStatusCallback: "https://" + cfg.ExternalHostname + recordingPath,
 		}
+		if cfg.TwilioTranscribe {
+			// Only the transcription callback makes an entry, or there'd
+			// be two of each
+			record.RecordingStatusCallback = ""
+			record.Transcribe = "true"
+			record.TranscribeCallback = "https://" + cfg.ExternalHostname + transcriptionPath
+		}
+		if cfg.CancelKey != "" {
+			// Pressing # still finishes the recording normally
+			record.FinishOnKey = "#"
+			if cfg.CancelKey != "#" {
+				record.FinishOnKey += cfg.CancelKey
+			}
+			record.Action = "https://" + cfg.ExternalHostname + recordedPath
+		}
 
 		twimlResult, err := twiml.Voice([]twiml.Element{say, record})
 		if err != nil {
@@ -78,80 +1112,244 @@ func main() {
 			c.Header("Content-Type", "text/xml")
 			c.String(http.StatusOK, twimlResult)
 		}
-	})
+	}
+}
 
-	router.POST(recordingPath, signatureChecker, whitelistChecker, func(c *gin.Context) {
-		c.Request.ParseForm()
+// Ends the call once the recording finishes, remembering calls whose recording
+// was discarded with CANCEL_KEY
+func recordedHandler(cfg config, cancelled *cancelledCalls) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		form := twilioForm(c)
+		var elements []twiml.Element
+		if cfg.CancelKey != "" && form.Get("Digits") == cfg.CancelKey {
+			cancelled.add(form.Get("CallSid"))
+			logf(c.Request.Context(), "Recording cancelled: %s", form.Get("RecordingSid"))
+			elements = append(elements, &twiml.VoiceSay{Message: "Recording discarded."})
+		}
+		elements = append(elements, &twiml.VoiceHangup{})
 
-		status := c.Request.PostForm.Get("RecordingStatus")
-		if status != "completed" {
-			c.AbortWithError(http.StatusBadRequest, errors.New("incomplete recording"))
-			return
+		twimlResult, err := twiml.Voice(elements)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		} else {
+			c.Header("Content-Type", "text/xml")
+			c.String(http.StatusOK, twimlResult)
 		}
+	}
+}
 
-		recordingUrl := c.Request.PostForm.Get("RecordingUrl")
-		go processRecording(cfg, model, recordingUrl)
-		c.String(http.StatusOK, "Thanks!")
-	})
+// Builds the greeting read at the start of a call, addressing the caller by
+// name and reminding them of their last entry if either is known
+func greeting(name, lastTitle string) string {
+	prompt := "What's on your mind?"
+	if lastTitle != "" {
+		prompt = "Last time you said: " + lastTitle + ". " + prompt
+	}
+	switch {
+	case name != "" && lastTitle != "":
+		prompt = "Hi " + name + ". " + prompt
+	case name != "":
+		prompt = "Hi " + name + ", what's on your mind?"
+	}
+	return prompt + " This call is recorded."
+}
+
+// Builds the greeting for a caller who hasn't made any entries yet
+func firstTimeGreeting(name, prompt string) string {
+	if name != "" {
+		prompt = "Hi " + name + ". " + prompt
+	}
+	return prompt + " This call is recorded."
+}
 
-	router.Run(":80")
+// A recording reported by Twilio's recording status callback
+type recording struct {
+	Url      string        `json:"url"`
+	Sid      string        `json:"sid"`
+	Caller   string        `json:"caller"`
+	Duration time.Duration `json:"duration"`
+	CallSid  string        `json:"call_sid,omitempty"`
+	// Page created by NOTION_PLACEHOLDER when the recording was received
+	PlaceholderPageId string `json:"placeholder_page_id,omitempty"`
+	// Number of channels Twilio recorded, or zero if it didn't say
+	Channels int `json:"channels,omitempty"`
+	// Raw EncryptionDetails JSON, set if Twilio encrypted the recording
+	Encryption string `json:"encryption,omitempty"`
+	// Set if Twilio transcribed the recording, in which case it isn't
+	// downloaded or transcribed again
+	TwilioTranscript string `json:"twilio_transcript,omitempty"`
 }
 
-func processRecording(cfg config, model whisper.Model, url string) {
-	recording, err := downloadRecording(cfg, url)
+// Downloads the recording from Twilio, decrypting it if it was encrypted
+func downloadRecording(ctx context.Context, cfg config, rec recording) (*bytes.Reader, error) {
+	defer timer(ctx, "download recording")()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rec.Url, nil)
 	if err != nil {
-		fmt.Printf("download recording failed: %v\n", err)
-		return
+		return nil, err
 	}
+	req.SetBasicAuth(cfg.TwilioAccountSid, cfg.TwilioAuthToken)
 
-	resampled, err := resampleRecording(recording)
+	res, err := cfg.httpClient().Do(req)
 	if err != nil {
-		fmt.Printf("resample recording failed: %v\n", err)
-		return
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
 	}
 
-	transcript, err := transcribeRecording(model, resampled)
+	recording, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("transcribe recording failed: %v\n", err)
-		return
+		return nil, err
+	}
+	if err := res.Body.Close(); err != nil {
+		return nil, err
+	}
+	if rec.Encryption != "" {
+		recording, err = decryptRecording(cfg.RecordingKey.PrivateKey, rec.Encryption, recording)
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypt recording failed")
+		}
+	}
+	return bytes.NewReader(recording), nil
+}
+
+// Deletes the recording from Twilio, which otherwise keeps it indefinitely
+func deleteRecording(ctx context.Context, cfg config, rec recording) error {
+	defer timer(ctx, "delete recording")()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, rec.Url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(cfg.TwilioAccountSid, cfg.TwilioAuthToken)
+
+	res, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Recording SIDs are "RE" followed by 32 hex digits
+var recordingSidPattern = regexp.MustCompile(`^RE[0-9a-fA-F]{32}$`)
+
+// Looks up a recording and the call it was made on through Twilio's REST API,
+// for reprocessing a recording whose status callback is long gone
+func fetchRecording(ctx context.Context, cfg config, sid string) (recording, error) {
+	accountUrl := "https://api.twilio.com/2010-04-01/Accounts/" + cfg.TwilioAccountSid
+	rec := recording{Url: accountUrl + "/Recordings/" + sid, Sid: sid}
+
+	var details struct {
+		CallSid    string          `json:"call_sid"`
+		Duration   string          `json:"duration"`
+		Channels   int             `json:"channels"`
+		Encryption json.RawMessage `json:"encryption_details"`
+	}
+	if err := getTwilioJson(ctx, cfg, rec.Url+".json", &details); err != nil {
+		return rec, errors.Wrap(err, "fetch recording failed")
+	}
+	rec.CallSid = details.CallSid
+	rec.Channels = details.Channels
+	if seconds, err := strconv.Atoi(details.Duration); err == nil {
+		rec.Duration = time.Duration(seconds) * time.Second
+	}
+	if len(details.Encryption) > 0 && string(details.Encryption) != "null" {
+		rec.Encryption = string(details.Encryption)
 	}
-	fmt.Printf("Transcript: %s\n", transcript)
 
-	if err := uploadTranscript(context.Background(), cfg, transcript); err != nil {
-		fmt.Printf("upload transcript failed: %v\n", err)
+	var call struct {
+		From string `json:"from"`
 	}
+	if err := getTwilioJson(ctx, cfg, accountUrl+"/Calls/"+rec.CallSid+".json", &call); err != nil {
+		return rec, errors.Wrap(err, "fetch call failed")
+	}
+	rec.Caller = call.From
+	return rec, nil
 }
 
-func downloadRecording(cfg config, url string) (*bytes.Reader, error) {
-	defer timer("download recording")()
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func getTwilioJson(ctx context.Context, cfg config, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.SetBasicAuth(cfg.TwilioAccountSid, cfg.TwilioAuthToken)
 
-	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := cfg.httpClient().Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
 	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
 
-	recording, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// Converts the recording into a 16kHz mono WAV file, preferring ffmpeg when it
+// is configured and falling back to the native decoder if ffmpeg fails.
+func prepareRecording(ctx context.Context, cfg config, recording io.ReadSeeker) (*bytes.Reader, error) {
+	if ready, ok := whisperReadyRecording(recording); ok {
+		logf(ctx, "Recording is already %dHz mono, skipping conversion", whisper.SampleRate)
+		return ready, nil
 	}
-	if err := res.Body.Close(); err != nil {
-		return nil, err
+	if cfg.FfmpegPath != "" {
+		converted, err := convertRecording(ctx, cfg.FfmpegPath, recording, allChannels)
+		if err == nil {
+			return converted, nil
+		}
+		logf(ctx, "ffmpeg conversion failed, falling back to native decoder: %v", err)
+		if _, err := recording.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
 	}
-	return bytes.NewReader(recording), nil
+	return resampleRecording(ctx, recording, cfg.ResampleQuality)
+}
+
+// Splits a dual-channel recording into one prepared recording per channel.
+// Only ffmpeg can split channels, so there's no fallback to the native
+// decoder.
+func prepareChannels(ctx context.Context, cfg config, recording io.ReadSeeker, numChannels int) ([]*bytes.Reader, error) {
+	channels := make([]*bytes.Reader, numChannels)
+	for i := range channels {
+		if _, err := recording.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var err error
+		if channels[i], err = convertRecording(ctx, cfg.FfmpegPath, recording, i); err != nil {
+			return nil, errors.Wrapf(err, "split channel %d failed", i)
+		}
+	}
+	return channels, nil
+}
+
+// Returns the recording as it is if it's a WAV that whisper can already take,
+// 16kHz and mono, which is what Twilio usually delivers. Otherwise, returns
+// false with the recording rewound for conversion.
+func whisperReadyRecording(recording io.ReadSeeker) (*bytes.Reader, bool) {
+	_, format, err := bwav.Decode(recording)
+	if _, seekErr := recording.Seek(0, io.SeekStart); seekErr != nil || err != nil {
+		return nil, false
+	}
+	if format.SampleRate != whisper.SampleRate || format.NumChannels != whisperNumChans {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(recording)
+	if err != nil {
+		recording.Seek(0, io.SeekStart)
+		return nil, false
+	}
+	return bytes.NewReader(data), true
 }
 
-func resampleRecording(recording io.ReadSeeker) (*bytes.Reader, error) {
-	defer timer("resample recording")()
+// Resamples the recording to whisper's sample rate. Higher qualities give a
+// more accurate result at the cost of speed, see beep.Resample.
+func resampleRecording(ctx context.Context, recording io.ReadSeeker, quality int) (*bytes.Reader, error) {
+	defer timer(ctx, "resample recording")()
 
 	streamer, format, err := bwav.Decode(recording)
 	if err != nil {
@@ -163,7 +1361,7 @@ func resampleRecording(recording io.ReadSeeker) (*bytes.Reader, error) {
 		return nil, err
 	}
 
-	resampler := beep.Resample(3, format.SampleRate, whisper.SampleRate, streamer)
+	resampler := beep.Resample(quality, format.SampleRate, whisper.SampleRate, streamer)
 	resampled := ws.WriterSeeker{}
 	err = bwav.Encode(&resampled, resampler, beep.Format{
 		SampleRate:  whisper.SampleRate,
@@ -176,66 +1374,762 @@ func resampleRecording(recording io.ReadSeeker) (*bytes.Reader, error) {
 	return resampled.BytesReader(), nil
 }
 
-func transcribeRecording(model whisper.Model, recording io.ReadSeeker) (string, error) {
-	defer timer("transcribe recording")()
+type transcribeOptions struct {
+	// Whisper language code, or empty for the model's default
+	Language string
+	// Whether to scale the audio up to a consistent peak level first
+	Normalize bool
+	// Length of the chunks the audio is transcribed in, or zero for the
+	// default
+	ChunkSeconds int
+	// Number of threads whisper uses for each chunk, or zero for the
+	// bindings' default of one per CPU
+	Threads uint
+	// Longest segment whisper produces, in tokens, or zero for no limit
+	MaxTokensPerSegment uint
+	// Whether whisper speeds up the audio 2x, trading accuracy for time
+	SpeedUp bool
+	// If not zero, words containing a token less likely than this are
+	// marked as uncertain in the transcript
+	UncertainBelow float32
+	// If not nil, called with each segment as soon as whisper produces it
+	OnSegment func(whisper.Segment)
+	// Whether to translate into English rather than transcribe
+	Translate bool
+	// Text to prime the openai transcriber with, and names and jargon for
+	// hosted transcribers to listen for. The pinned whisper bindings can't
+	// take either.
+	Prompt     string
+	Vocabulary []string
+}
+
+// Returns the options the caller's recordings are transcribed with
+func (cfg config) transcribeOptions(caller string) transcribeOptions {
+	opts := transcribeOptions{
+		Language:            cfg.language(caller),
+		Normalize:           cfg.AudioNormalize,
+		ChunkSeconds:        cfg.ChunkSeconds,
+		MaxTokensPerSegment: cfg.WhisperMaxTokensPerSegment,
+		SpeedUp:             cfg.WhisperSpeedUp,
+		Prompt:              cfg.InitialPrompt,
+		Vocabulary:          cfg.Vocabulary,
+	}
+	if cfg.IncludeAlternatives {
+		opts.UncertainBelow = float32(cfg.AltConfidence)
+	}
+	return opts
+}
 
+// Returns the length of the audio in a WAV file, leaving the reader at the
+// start of the file
+func wavDuration(recording io.ReadSeeker) (time.Duration, error) {
 	dec := gwav.NewDecoder(recording)
-	buf, err := dec.FullPCMBuffer()
+	if err := dec.FwdToPCM(); err != nil {
+		return 0, err
+	}
+	bytesPerSecond := int64(dec.SampleRate) * int64(dec.NumChans) * int64(dec.BitDepth/8)
+	if bytesPerSecond == 0 {
+		return 0, errors.New("invalid wav format")
+	}
+	duration := time.Duration(dec.PCMLen()) * time.Second / time.Duration(bytesPerSecond)
+	_, err := recording.Seek(0, io.SeekStart)
+	return duration, err
+}
+
+// Transcribes the recording, returning the text along with the average
+// probability of its tokens as a measure of confidence. The recording is
+// decoded and transcribed a chunk at a time to bound memory use. Given more
+// than one model instance, chunks are transcribed on each at once.
+func transcribeRecording(ctx context.Context, models []whisper.Model, recording io.ReadSeeker, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "transcribe recording")()
+
+	chunkSeconds := opts.ChunkSeconds
+	if chunkSeconds <= 0 {
+		chunkSeconds = defaultChunkSeconds
+	}
+	chunkSamples := chunkSeconds * whisper.SampleRate
+
+	// Normalization has to look at the whole recording to find its peak
+	// before any of it is transcribed
+	var gain float32 = 1
+	if opts.Normalize {
+		peak, err := wavPeak(recording, chunkSamples)
+		if err != nil {
+			return transcriptResult{}, err
+		}
+		gain = normalizeGain(peak)
+		logf(ctx, "Normalizing audio with gain %.2f", gain)
+	}
+
+	pcm, err := newPCMReader(recording, chunkSamples)
 	if err != nil {
-		return "", err
+		return transcriptResult{}, err
+	}
+	if len(models) > 1 {
+		return transcribeChunksConcurrently(models, pcm, gain, opts)
+	}
+	var t transcription
+	var offset time.Duration
+	for {
+		data, err := pcm.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return transcriptResult{}, err
+		}
+		if gain != 1 {
+			applyGain(data, gain)
+		}
+		if err := transcribeChunk(models[0], data, offset, opts, &t); err != nil {
+			if _, ok := err.(truncatedError); ok {
+				return t.result(), err
+			}
+			return transcriptResult{}, err
+		}
+		offset += time.Duration(len(data)) * time.Second / whisper.SampleRate
+	}
+	return t.result(), nil
+}
+
+// Transcribes chunks on several model instances at once, each instance taking
+// the next chunk as it finishes one, and puts the results back in recording
+// order. Every chunk in flight holds a copy of its samples, so memory grows
+// with the number of instances rather than the length of the recording.
+func transcribeChunksConcurrently(models []whisper.Model, pcm *pcmReader, gain float32, opts transcribeOptions) (transcriptResult, error) {
+	type chunk struct {
+		index  int
+		data   []float32
+		offset time.Duration
+	}
+	// The CPUs whisper would give each chunk are shared out between them
+	if opts.Threads == 0 {
+		opts.Threads = uint(runtime.NumCPU() / len(models))
+		if opts.Threads == 0 {
+			opts.Threads = 1
+		}
+	}
+	var segments *orderedSegments
+	if opts.OnSegment != nil {
+		segments = newOrderedSegments(opts.OnSegment)
+	}
+
+	var mu sync.Mutex
+	var results []transcription
+	var errs []error
+	// Closed on the first failure, after which no more chunks are started
+	failed := make(chan struct{})
+	var failOnce sync.Once
+
+	chunks := make(chan chunk)
+	var wg sync.WaitGroup
+	for _, model := range models {
+		wg.Add(1)
+		go func(model whisper.Model) {
+			defer wg.Done()
+			for c := range chunks {
+				chunkOpts := opts
+				if segments != nil {
+					index := c.index
+					chunkOpts.OnSegment = func(segment whisper.Segment) {
+						segments.add(index, segment)
+					}
+				}
+				var t transcription
+				err := transcribeChunk(model, c.data, c.offset, chunkOpts, &t)
+				if segments != nil {
+					segments.finish(c.index, err != nil)
+				}
+				mu.Lock()
+				results[c.index], errs[c.index] = t, err
+				mu.Unlock()
+				if err != nil {
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}(model)
+	}
+
+	var readErr error
+	var offset time.Duration
+read:
+	for index := 0; ; index++ {
+		data, err := pcm.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			readErr = err
+			break
+		}
+		// The reader's buffer is reused for the next chunk
+		data = append([]float32(nil), data...)
+		if gain != 1 {
+			applyGain(data, gain)
+		}
+		mu.Lock()
+		results, errs = append(results, transcription{}), append(errs, nil)
+		mu.Unlock()
+		select {
+		case chunks <- chunk{index, data, offset}:
+		case <-failed:
+			break read
+		}
+		offset += time.Duration(len(data)) * time.Second / whisper.SampleRate
+	}
+	close(chunks)
+	wg.Wait()
+
+	// Chunks before a failed one were all started, so they're complete
+	var t transcription
+	for i := range results {
+		t.add(results[i])
+		if err := errs[i]; err != nil {
+			if _, ok := err.(truncatedError); ok {
+				return t.result(), err
+			}
+			return transcriptResult{}, err
+		}
+	}
+	if readErr != nil {
+		return transcriptResult{}, readErr
+	}
+	return t.result(), nil
+}
+
+// Passes segments on in recording order while chunks are transcribed out of
+// order. Segments of the earliest unfinished chunk go straight through, and
+// later chunks' wait for it to finish. Nothing after a failed chunk is passed
+// on, matching the transcript.
+type orderedSegments struct {
+	mu sync.Mutex
+	fn func(whisper.Segment)
+	// Earliest chunk not yet finished
+	next     int
+	finished map[int]bool
+	pending  map[int][]whisper.Segment
+	// Earliest failed chunk, or -1
+	failed int
+}
+
+func newOrderedSegments(fn func(whisper.Segment)) *orderedSegments {
+	return &orderedSegments{
+		fn:       fn,
+		finished: map[int]bool{},
+		pending:  map[int][]whisper.Segment{},
+		failed:   -1,
+	}
+}
+
+func (o *orderedSegments) add(chunk int, segment whisper.Segment) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failed >= 0 && chunk > o.failed {
+		return
+	}
+	if chunk == o.next {
+		o.fn(segment)
+	} else {
+		o.pending[chunk] = append(o.pending[chunk], segment)
+	}
+}
+
+func (o *orderedSegments) finish(chunk int, failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if failed && (o.failed < 0 || chunk < o.failed) {
+		o.failed = chunk
+	}
+	o.finished[chunk] = true
+	for o.finished[o.next] && o.next != o.failed {
+		delete(o.finished, o.next)
+		o.next++
+		for _, segment := range o.pending[o.next] {
+			o.fn(segment)
+		}
+		delete(o.pending, o.next)
+	}
+}
+
+// Returned along with the partial transcript when whisper fails partway
+// through reading segments, since what came before is still good
+type truncatedError struct {
+	err error
+}
+
+func (e truncatedError) Error() string {
+	return "transcript truncated: " + e.err.Error()
+}
+
+type transcriptResult struct {
+	Text string
+	// Average probability of the transcript's tokens
+	Confidence float64
+	// Language whisper transcribed in
+	Language string
+	// Where each segment falls in the recording, if the transcriber says
+	Segments []timedSegment
+	// The transcript in the language spoken, when Text is a translation
+	Original string
+}
+
+// Segments transcribed so far, across chunks
+type transcription struct {
+	texts         []string
+	segments      []timedSegment
+	confidenceSum float64
+	numSegments   int
+	language      string
+}
+
+// Appends a later chunk's transcription
+func (t *transcription) add(chunk transcription) {
+	t.texts = append(t.texts, chunk.texts...)
+	t.segments = append(t.segments, chunk.segments...)
+	t.confidenceSum += chunk.confidenceSum
+	t.numSegments += chunk.numSegments
+	if chunk.language != "" {
+		t.language = chunk.language
+	}
+}
+
+func (t *transcription) result() transcriptResult {
+	result := transcriptResult{
+		Text:     strings.Join(dedupeSegments(t.texts), ""),
+		Language: t.language,
+		Segments: t.segments,
+	}
+	if t.numSegments > 0 {
+		result.Confidence = t.confidenceSum / float64(t.numSegments)
 	}
-	data := buf.AsFloat32Buffer().Data
+	return result
+}
 
+// Transcribes a chunk of audio starting at offset into the recording. Each
+// chunk gets a new context, since a context's segments can only be read once.
+func transcribeChunk(model whisper.Model, data []float32, offset time.Duration, opts transcribeOptions, t *transcription) error {
 	context, err := model.NewContext()
 	if err != nil {
-		return "", err
+		return err
 	}
-	if err := context.Process(data, nil); err != nil {
-		return "", err
+	if opts.Language != "" {
+		// English-only models can't be given a language, but are already
+		// transcribing in the one they'd be given
+		if context.IsMultilingual() {
+			if err := context.SetLanguage(opts.Language); err != nil {
+				return errors.Wrapf(err, "set language %q failed", opts.Language)
+			}
+		} else if opts.Language != "en" {
+			return fmt.Errorf("model is english-only, can't transcribe %q", opts.Language)
+		}
+	}
+	t.language = context.Language()
+	context.SetTranslate(opts.Translate)
+	// Contexts share their model's state, so chunks are only ever
+	// transcribed at once on separate model instances
+	if opts.Threads > 0 {
+		context.SetThreads(opts.Threads)
+	}
+	if opts.MaxTokensPerSegment > 0 {
+		context.SetMaxTokensPerSegment(opts.MaxTokensPerSegment)
+	}
+	context.SetSpeedup(opts.SpeedUp)
+
+	// Passing a callback puts whisper into single segment mode, so only do
+	// it when someone is listening
+	var cb whisper.SegmentCallback
+	if opts.OnSegment != nil {
+		cb = func(segment whisper.Segment) {
+			segment.Start += offset
+			segment.End += offset
+			opts.OnSegment(segment)
+		}
+	}
+	if err := context.Process(data, cb); err != nil {
+		return err
 	}
 
-	var sb strings.Builder
 	for {
 		segment, err := context.NextSegment()
 		if err == io.EOF {
-			break
+			return nil
 		} else if err != nil {
-			return "", err
+			return truncatedError{err}
+		}
+		text := segment.Text
+		if opts.UncertainBelow > 0 {
+			text = markUncertainWords(segment.Tokens, context.IsText, opts.UncertainBelow)
+		}
+		t.texts = append(t.texts, text)
+		segment.Start += offset
+		segment.End += offset
+		t.segments = append(t.segments, newTimedSegment(segment))
+
+		var probSum float64
+		var numTokens int
+		for _, token := range segment.Tokens {
+			if context.IsText(token) {
+				probSum += float64(token.P)
+				numTokens++
+			}
+		}
+		if numTokens > 0 {
+			t.confidenceSum += probSum / float64(numTokens)
+			t.numSegments++
 		}
-		sb.WriteString(segment.Text)
 	}
-	return sb.String(), nil
 }
 
-func uploadTranscript(ctx context.Context, cfg config, transcript string) error {
-	defer timer("upload transcript")()
+// A journal entry ready to be uploaded
+type entry struct {
+	Transcript string    `json:"transcript"`
+	Date       time.Time `json:"date"`
+	RecordedAt time.Time `json:"recorded_at"`
+	Caller     string    `json:"caller"`
+	// Length of the recording, if Twilio reported it
+	Duration     time.Duration `json:"duration"`
+	RecordingSid string        `json:"recording_sid"`
+	CallSid      string        `json:"call_sid,omitempty"`
+	// Set when the transcription's confidence is below MIN_CONFIDENCE
+	LowConfidence bool `json:"low_confidence"`
+	// Optional summary from the transcript webhook
+	Summary string `json:"summary,omitempty"`
+	// Placeholder page to fill in rather than creating a new page
+	PlaceholderPageId string `json:"placeholder_page_id,omitempty"`
+	// Language the entry was transcribed in
+	Language string `json:"language,omitempty"`
+	// Set when transcription failed partway through, leaving only the start
+	// of the recording in the transcript
+	Truncated bool `json:"truncated,omitempty"`
+	// Title spoken after TITLE_PHRASE, used instead of the start of the
+	// transcript
+	Title string `json:"title,omitempty"`
+	// Page for the relation property, picked by the name spoken after
+	// RELATION_PHRASE
+	RelatedPageId string `json:"related_page_id,omitempty"`
+	// Where each part of the transcript falls in the recording. Only set
+	// when the recording makes a single entry.
+	Segments []timedSegment `json:"segments,omitempty"`
+	// The transcript in the language spoken, when the transcript is an
+	// English translation. Only set when the recording makes a single
+	// entry.
+	OriginalTranscript string `json:"original_transcript,omitempty"`
+}
+
+// Creates a page for the entry, returning its ID
+func uploadTranscript(ctx context.Context, cfg config, e entry) (string, error) {
+	defer timer(ctx, "upload transcript")()
 
-	notionClient := notion.NewClient(cfg.NotionAuthToken)
-	_, err := notionClient.CreatePage(ctx, notion.CreatePageParams{
-		ParentType: notion.ParentTypeDatabase,
-		ParentID:   cfg.NotionDatabaseId,
-		DatabasePageProperties: &notion.DatabasePageProperties{
-			"Date": notion.DatabasePageProperty{
-				Date: &notion.Date{
-					Start: notion.NewDateTime(time.Now(), false),
-				},
-			},
-			"Title": notion.DatabasePageProperty{
-				Title: []notion.RichText{
-					{Text: &notion.Text{Content: transcriptTitle(transcript)}},
-				},
+	e.Transcript = sanitizeForNotion(e.Transcript)
+	e.Summary = sanitizeForNotion(e.Summary)
+	e.OriginalTranscript = sanitizeForNotion(e.OriginalTranscript)
+
+	target := cfg.notionTarget(e.Caller)
+	// Notion only takes so many blocks with the page, so any more are
+	// appended once it's created
+	blocks := entryBlocks(cfg, e)
+	var rest []notion.Block
+	if len(blocks) > maxChildBlocks {
+		blocks, rest = blocks[:maxChildBlocks], blocks[maxChildBlocks:]
+	}
+	params := notion.CreatePageParams{
+		Children: blocks,
+	}
+	if cfg.NotionSentimentIcon {
+		emoji := sentimentEmoji(e.Transcript)
+		params.Icon = &notion.Icon{Type: notion.IconTypeEmoji, Emoji: &emoji}
+	}
+	params.Cover = cfg.pageCover(e.Caller)
+
+	if cfg.NotionParentType == "page" {
+		// Pages under a page parent can only have a title property
+		params.ParentType = notion.ParentTypePage
+		params.ParentID = target.PageId
+		params.Title = []notion.RichText{
+			{Text: &notion.Text{Content: entryTitle(e, cfg.DefaultTitle)}},
+		}
+	} else {
+		params.ParentType = notion.ParentTypeDatabase
+		params.ParentID = target.DatabaseId
+		params.DatabasePageProperties = databasePageProperties(cfg, e)
+	}
+
+	notionClient := cfg.notionClient(target.Token)
+	page, err := notionClient.CreatePage(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	if err := appendBlocks(ctx, notionClient, page.ID, rest); err != nil {
+		// Retrying would create the whole page again, so the partial one is
+		// archived rather than left as a duplicate
+		archived := true
+		_, archiveErr := notionClient.UpdatePage(ctx, page.ID, notion.UpdatePageParams{Archived: &archived})
+		if archiveErr != nil {
+			logf(ctx, "archive partial page failed: %v", archiveErr)
+		}
+		return "", errors.Wrap(err, "append blocks failed")
+	}
+	return page.ID, nil
+}
+
+// Appends the entry to the end of an existing page, leaving out whatever of
+// the transcript the page already has
+func appendTranscript(ctx context.Context, cfg config, pageId string, e entry) error {
+	defer timer(ctx, "append transcript")()
+
+	e.Transcript = sanitizeForNotion(e.Transcript)
+	e.Summary = sanitizeForNotion(e.Summary)
+	e.OriginalTranscript = sanitizeForNotion(e.OriginalTranscript)
+
+	// A redelivered callback would otherwise append the same transcript twice
+	notionClient := cfg.notionClient(cfg.notionTarget(e.Caller).Token)
+	existing, err := blockText(ctx, notionClient, pageId)
+	if err != nil {
+		return errors.Wrap(err, "read page failed")
+	}
+	e.Transcript = unsavedTranscript(existing, e.Transcript)
+	if e.Transcript == "" {
+		logf(ctx, "Transcript already on page %s, skipping append", pageId)
+		return nil
+	}
+
+	var blocks []notion.Block
+	if !cfg.BodyHeader {
+		// Without a header there'd be nothing separating the two calls
+		blocks = append(blocks, notion.ParagraphBlock{RichText: []notion.RichText{{
+			Text:        &notion.Text{Content: fmt.Sprintf(cfg.Locale.continued, cfg.Locale.time(e.RecordedAt))},
+			Annotations: &notion.Annotations{Italic: true, Color: notion.ColorGray},
+		}}})
+	}
+	blocks = append(blocks, entryBlocks(cfg, e)...)
+
+	return appendBlocks(ctx, notionClient, pageId, blocks)
+}
+
+// Builds the page body: an optional metadata line, the webhook's summary if
+// there is one, the transcript, and an optional divider
+func entryBlocks(cfg config, e entry) []notion.Block {
+	var blocks []notion.Block
+	if cfg.BodyHeader {
+		header := fmt.Sprintf(cfg.Locale.recorded, cfg.Locale.dateTime(e.RecordedAt))
+		if e.Caller != "" {
+			header += fmt.Sprintf(cfg.Locale.by, e.Caller)
+		}
+		annotations := &notion.Annotations{Italic: true, Color: notion.ColorGray}
+		richText := []notion.RichText{{Text: &notion.Text{Content: header}, Annotations: annotations}}
+		if e.CallSid != "" && cfg.NotionCallLink {
+			callSid := callSidText(cfg, e.CallSid)
+			callSid.Annotations = annotations
+			richText = append(richText,
+				notion.RichText{Text: &notion.Text{Content: cfg.Locale.call}, Annotations: annotations},
+				callSid,
+			)
+		}
+		blocks = append(blocks, notion.ParagraphBlock{RichText: richText})
+	}
+	if e.Summary != "" {
+		blocks = append(blocks, notion.QuoteBlock{RichText: splitRichText(e.Summary)})
+	}
+	blocks = append(blocks, bodyBlocks(cfg, e)...)
+	if e.OriginalTranscript != "" {
+		blocks = append(blocks, notion.ParagraphBlock{RichText: []notion.RichText{{
+			Text:        &notion.Text{Content: fmt.Sprintf(cfg.Locale.original, e.Language)},
+			Annotations: &notion.Annotations{Italic: true, Color: notion.ColorGray},
+		}}})
+		for _, body := range transcriptParagraphs(e.OriginalTranscript) {
+			blocks = append(blocks, notion.ParagraphBlock{RichText: body})
+		}
+	}
+	if cfg.BodyDivider {
+		blocks = append(blocks, notion.DividerBlock{})
+	}
+	return blocks
+}
+
+// Wraps the transcript in the configured type of block, one per paragraph when
+// it's labeled by speaker. Toggles are labeled with the entry's title, with the
+// transcript nested inside.
+func bodyBlocks(cfg config, e entry) []notion.Block {
+	paragraphs := transcriptParagraphs(e.Transcript)
+	var blocks []notion.Block
+	for _, body := range paragraphs {
+		if cfg.BodyBlock == "callout" {
+			blocks = append(blocks, notion.CalloutBlock{RichText: body})
+		} else {
+			blocks = append(blocks, notion.ParagraphBlock{RichText: body})
+		}
+	}
+	if cfg.BodyBlock == "toggle" {
+		return []notion.Block{notion.ToggleBlock{
+			RichText: []notion.RichText{{Text: &notion.Text{Content: entryTitle(e, cfg.DefaultTitle)}}},
+			Children: blocks,
+		}}
+	}
+	return blocks
+}
+
+// Speaker separation and diarization start each paragraph with a label
+var speakerLabelPattern = regexp.MustCompile(`^Speaker [A-Z0-9]+: `)
+
+// Splits a transcript labeled by speaker into its paragraphs, with the labels
+// in bold. Any other transcript is kept as one.
+func transcriptParagraphs(transcript string) [][]notion.RichText {
+	paragraphs := strings.Split(transcript, "\n\n")
+	for _, paragraph := range paragraphs {
+		if len(paragraphs) < 2 || !speakerLabelPattern.MatchString(paragraph) {
+			return [][]notion.RichText{splitRichText(transcript)}
+		}
+	}
+	var richTexts [][]notion.RichText
+	for _, paragraph := range paragraphs {
+		label := speakerLabelPattern.FindString(paragraph)
+		richText := []notion.RichText{{
+			Text:        &notion.Text{Content: label},
+			Annotations: &notion.Annotations{Bold: true},
+		}}
+		richTexts = append(richTexts, append(richText, splitRichText(paragraph[len(label):])...))
+	}
+	return richTexts
+}
+
+// Appends blocks to a page or block, in batches that are each within Notion's
+// limit
+func appendBlocks(ctx context.Context, client *notion.Client, blockId string, blocks []notion.Block) error {
+	for len(blocks) > 0 {
+		n := len(blocks)
+		if n > maxChildBlocks {
+			n = maxChildBlocks
+		}
+		if _, err := client.AppendBlockChildren(ctx, blockId, blocks[:n]); err != nil {
+			return err
+		}
+		blocks = blocks[n:]
+	}
+	return nil
+}
+
+// Splits text into rich text objects that are each within Notion's length
+// limit
+func splitRichText(text string) []notion.RichText {
+	var richText []notion.RichText
+	runes := []rune(text)
+	for len(runes) > maxRichTextLen {
+		richText = append(richText, notion.RichText{Text: &notion.Text{Content: string(runes[:maxRichTextLen])}})
+		runes = runes[maxRichTextLen:]
+	}
+	return append(richText, notion.RichText{Text: &notion.Text{Content: string(runes)}})
+}
+
+func databasePageProperties(cfg config, e entry) *notion.DatabasePageProperties {
+	properties := notion.DatabasePageProperties{
+		"Date": notion.DatabasePageProperty{
+			Date: &notion.Date{
+				Start: notion.NewDateTime(e.Date, false),
 			},
 		},
-		Children: []notion.Block{
-			notion.ParagraphBlock{RichText: []notion.RichText{
-				{Text: &notion.Text{Content: transcript}},
-			}},
+		"Title": notion.DatabasePageProperty{
+			Title: []notion.RichText{
+				{Text: &notion.Text{Content: entryTitle(e, cfg.DefaultTitle)}},
+			},
 		},
-	})
-	return err
+	}
+	if cfg.NotionStatusProperty != "" && cfg.NotionStatusValue != "" {
+		status := &notion.SelectOptions{Name: cfg.NotionStatusValue}
+		if cfg.NotionStatusType == "select" {
+			properties[cfg.NotionStatusProperty] = notion.DatabasePageProperty{Select: status}
+		} else {
+			properties[cfg.NotionStatusProperty] = notion.DatabasePageProperty{Status: status}
+		}
+	}
+
+	if cfg.NotionFlagProperty != "" {
+		properties[cfg.NotionFlagProperty] = notion.DatabasePageProperty{Checkbox: &e.LowConfidence}
+	}
+
+	if cfg.NotionLanguageProperty != "" && e.Language != "" {
+		properties[cfg.NotionLanguageProperty] = notion.DatabasePageProperty{
+			Select: &notion.SelectOptions{Name: e.Language},
+		}
+	}
+
+	if cfg.GroupBy != "none" {
+		group := entryGroup(cfg.GroupBy, e.Date.In(cfg.Timezone.loc()))
+		properties[cfg.NotionGroupProperty] = notion.DatabasePageProperty{
+			Select: &notion.SelectOptions{Name: group},
+		}
+	}
+
+	if cfg.NotionRelationProperty != "" {
+		related := e.RelatedPageId
+		if related == "" {
+			related = cfg.NotionRelationDefault
+		}
+		if related != "" {
+			properties[cfg.NotionRelationProperty] = notion.DatabasePageProperty{
+				Relation: []notion.Relation{{ID: related}},
+			}
+		}
+	}
+
+	if cfg.NotionCallProperty != "" && e.CallSid != "" {
+		properties[cfg.NotionCallProperty] = notion.DatabasePageProperty{
+			RichText: []notion.RichText{callSidText(cfg, e.CallSid)},
+		}
+	}
+
+	return &properties
+}
+
+// The caller's cover image, or the default if they don't have one. Returns
+// nil if neither is set, leaving the page without a cover.
+func (cfg config) pageCover(caller string) *notion.Cover {
+	cover, ok := cfg.CallerCoverMap[caller]
+	if !ok {
+		cover = cfg.NotionDefaultCover
+	}
+	if cover == "" {
+		return nil
+	}
+	return &notion.Cover{Type: notion.FileTypeExternal, External: &notion.FileExternal{URL: cover}}
+}
+
+// The CallSid, linked to the call in the Twilio console if NOTION_CALL_LINK
+// is set
+func callSidText(cfg config, callSid string) notion.RichText {
+	text := &notion.Text{Content: callSid}
+	if cfg.NotionCallLink {
+		text.Link = &notion.Link{URL: twilioCallLogUrl + callSid}
+	}
+	return notion.RichText{Text: text}
+}
+
+func entryTitle(e entry, defaultTitle string) string {
+	title := e.Title
+	if title == "" {
+		title = transcriptTitle(e.Transcript, defaultTitle)
+	}
+	if e.LowConfidence {
+		return lowConfidenceFlag + title
+	}
+	return title
+}
+
+// Drops invalid UTF-8 and control characters other than newlines and tabs,
+// either of which can get a page rejected by Notion
+func sanitizeForNotion(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
 }
 
-func transcriptTitle(transcript string) string {
+// Truncates the transcript to make a title, falling back to defaultTitle if
+// there's nothing but whitespace to truncate
+func transcriptTitle(transcript, defaultTitle string) string {
+	if strings.TrimSpace(transcript) == "" {
+		return defaultTitle
+	}
 	runes := []rune(transcript)
 	if len(runes) <= maxTitleLen {
 		return transcript
@@ -243,16 +2137,74 @@ func transcriptTitle(transcript string) string {
 	return string(runes[:maxTitleLen]) + "..."
 }
 
+// Reads the body of a Twilio callback once and parses its form, stashing the
+// params in the gin context for the middleware and handlers that follow. The
+// body is restored afterwards so that it can still be read directly.
+func parseTwilioForm() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err := c.Request.ParseForm(); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		c.Set(twilioFormKey, c.Request.PostForm)
+		c.Next()
+	}
+}
+
+// Returns the form parsed by parseTwilioForm
+func twilioForm(c *gin.Context) url.Values {
+	return c.MustGet(twilioFormKey).(url.Values)
+}
+
 // Snippet adapted from:
 // https://www.twilio.com/docs/usage/tutorials/how-to-secure-your-gin-project-by-validating-incoming-twilio-requests
-func checkTwilioSignature(validator *client.RequestValidator, hostname string) gin.HandlerFunc {
+//
+// When relaxedHost is set, signatures for the host the request was sent to are
+// accepted as well as those for the configured hostname
+func checkTwilioSignature(validator *client.RequestValidator, hostname string, relaxedHost bool, trustedProxies []*net.IPNet) gin.HandlerFunc {
+	var firstRequest sync.Once
 	return func(c *gin.Context) {
-		url := "https://" + hostname + c.Request.URL.Path
+		// Twilio signs the URL it sent the request to. When serving TLS
+		// directly that's https, and otherwise TLS is terminated upstream,
+		// which a trusted reverse proxy reports in the forwarding headers.
+		scheme, host := "https", hostname
+		requestHost := c.Request.Host
+		if c.Request.TLS == nil && isTrustedProxy(trustedProxies, c.RemoteIP()) {
+			if proto := forwardedValue(c, "X-Forwarded-Proto"); proto != "" {
+				scheme = proto
+			}
+			if fwdHost := forwardedValue(c, "X-Forwarded-Host"); fwdHost != "" {
+				host, requestHost = fwdHost, fwdHost
+			}
+		}
+
+		// A hostname that doesn't match the one Twilio calls fails every
+		// signature without saying why, so the first request is compared
+		firstRequest.Do(func() {
+			if strings.EqualFold(host, requestHost) {
+				logf(c.Request.Context(), "Request host matches EXTERNAL_HOSTNAME: %s", host)
+			} else {
+				logf(c.Request.Context(), "EXTERNAL_HOSTNAME %q doesn't match request host %q, Twilio signatures will fail", host, requestHost)
+			}
+		})
+
+		url := scheme + "://" + host + c.Request.URL.RequestURI()
 		signature := c.Request.Header.Get("X-Twilio-Signature")
+		if signature == "" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
 
-		c.Request.ParseForm()
 		params := map[string]string{}
-		for key, values := range c.Request.PostForm {
+		for key, values := range twilioForm(c) {
 			if len(values) != 1 {
 				c.AbortWithStatus(http.StatusBadRequest)
 				return
@@ -260,7 +2212,14 @@ func checkTwilioSignature(validator *client.RequestValidator, hostname string) g
 			params[key] = values[0]
 		}
 
-		if !validator.Validate(url, params, signature) {
+		valid := validator.Validate(url, params, signature)
+		if !valid && relaxedHost && !strings.EqualFold(host, requestHost) {
+			url = scheme + "://" + requestHost + c.Request.URL.RequestURI()
+			if valid = validator.Validate(url, params, signature); valid {
+				logf(c.Request.Context(), "Signature only valid for request host %q, check EXTERNAL_HOSTNAME", requestHost)
+			}
+		}
+		if !valid {
 			c.AbortWithStatus(http.StatusForbidden)
 		} else {
 			c.Next()
@@ -268,16 +2227,49 @@ func checkTwilioSignature(validator *client.RequestValidator, hostname string) g
 	}
 }
 
-func checkCallerWhitelist(callerWhitelist []string) gin.HandlerFunc {
+func checkAdminSecret(secret string) gin.HandlerFunc {
+	expected := []byte("Bearer " + secret)
+
+	return func(c *gin.Context) {
+		actual := []byte(c.Request.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(actual, expected) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+		} else {
+			c.Next()
+		}
+	}
+}
+
+// Trims spaces and drops empty and duplicate numbers, which a stray comma in
+// CALLER_WHITELIST would otherwise introduce
+func sanitizeCallerWhitelist(callerWhitelist []string) []string {
+	var sanitized []string
+	seen := map[string]bool{}
+	for _, num := range callerWhitelist {
+		num = strings.TrimSpace(num)
+		if num == "" || seen[num] {
+			continue
+		}
+		seen[num] = true
+		sanitized = append(sanitized, num)
+	}
+	return sanitized
+}
+
+// When disabled, every caller is allowed, with a warning logged for each
+// request so that it can't be left disabled unnoticed
+func checkCallerWhitelist(callerWhitelist []string, disabled bool) gin.HandlerFunc {
 	allowed := map[string]bool{}
 	for _, num := range callerWhitelist {
 		allowed[num] = true
 	}
 
 	return func(c *gin.Context) {
-		c.Request.ParseForm()
-		caller := c.Request.PostForm.Get("From")
-		if !allowed[caller] {
+		caller := twilioForm(c).Get("From")
+		if disabled {
+			logf(c.Request.Context(), "WARNING: caller whitelist disabled, allowing %s (whitelisted: %t)", caller, allowed[caller])
+			c.Next()
+		} else if !allowed[caller] {
 			twimlResult, err := twiml.Voice([]twiml.Element{&twiml.VoiceReject{}})
 			if err != nil {
 				c.AbortWithError(http.StatusInternalServerError, err)
@@ -285,6 +2277,8 @@ func checkCallerWhitelist(callerWhitelist []string) gin.HandlerFunc {
 				c.Header("Content-Type", "text/xml")
 				c.String(http.StatusOK, twimlResult)
 			}
+			// Otherwise the call would be answered as well
+			c.Abort()
 		} else {
 			c.Next()
 		}
@@ -292,9 +2286,11 @@ func checkCallerWhitelist(callerWhitelist []string) gin.HandlerFunc {
 }
 
 // From https://stackoverflow.com/a/45766707
-func timer(name string) func() {
+func timer(ctx context.Context, name string) func() {
 	start := time.Now()
 	return func() {
-		fmt.Printf("%s took %v\n", name, time.Since(start))
+		elapsed := time.Since(start)
+		stats.observe(name, elapsed)
+		logf(ctx, "%s took %v", name, elapsed)
 	}
 }
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caarlos0/env"
+	"github.com/dstotijn/go-notion"
+	"github.com/faiface/beep"
+	bwav "github.com/faiface/beep/wav"
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	ws "github.com/orcaman/writerseeker"
+)
+
+// Encodes a 440Hz sine wave as a 16-bit WAV
+func testWav(tb testing.TB, sampleRate beep.SampleRate, numChannels, seconds int) *bytes.Reader {
+	tb.Helper()
+	total := seconds * int(sampleRate)
+	n := total
+	tone := beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		if n == 0 {
+			return 0, false
+		}
+		i := 0
+		for ; i < len(samples) && n > 0; i++ {
+			v := 0.5 * math.Sin(2*math.Pi*440*float64(total-n)/float64(sampleRate))
+			samples[i] = [2]float64{v, v}
+			n--
+		}
+		return i, true
+	})
+	w := ws.WriterSeeker{}
+	err := bwav.Encode(&w, tone, beep.Format{SampleRate: sampleRate, NumChannels: numChannels, Precision: 2})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return w.BytesReader()
+}
+
+// Decodes a WAV into its format and the samples of its first channel
+func readTestWav(t *testing.T, r *bytes.Reader) (beep.Format, []float64) {
+	t.Helper()
+	streamer, format, err := bwav.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []float64
+	buf := make([][2]float64, 512)
+	for {
+		n, ok := streamer.Stream(buf)
+		for _, sample := range buf[:n] {
+			samples = append(samples, sample[0])
+		}
+		if !ok {
+			break
+		}
+	}
+	return format, samples
+}
+
+func TestResampleRecording(t *testing.T) {
+	for _, sampleRate := range []beep.SampleRate{8000, 16000, 44100} {
+		resampled, err := resampleRecording(context.Background(), testWav(t, sampleRate, 1, 1), 3)
+		if err != nil {
+			t.Fatalf("%dHz: %v", sampleRate, err)
+		}
+		format, samples := readTestWav(t, resampled)
+		if format.SampleRate != whisper.SampleRate || format.NumChannels != 1 {
+			t.Errorf("%dHz: resampled to %dHz with %d channels, want %dHz mono", sampleRate, format.SampleRate, format.NumChannels, whisper.SampleRate)
+		}
+		// The resampler may drop a few samples at the end
+		if len(samples) < whisper.SampleRate-16 || len(samples) > whisper.SampleRate {
+			t.Errorf("%dHz: got %d samples, want about %d", sampleRate, len(samples), whisper.SampleRate)
+		}
+		// A second of 440Hz crosses zero 880 times, give or take the
+		// ends, whatever the sample rate
+		crossings := 0
+		for i := 1; i < len(samples); i++ {
+			if (samples[i-1] < 0) != (samples[i] < 0) {
+				crossings++
+			}
+		}
+		if crossings < 870 || crossings > 890 {
+			t.Errorf("%dHz: tone crosses zero %d times, want about 880", sampleRate, crossings)
+		}
+	}
+}
+
+func TestResampleRecordingRejectsStereo(t *testing.T) {
+	if _, err := resampleRecording(context.Background(), testWav(t, 8000, 2, 1), 3); err == nil {
+		t.Error("resampled a stereo recording, want an error")
+	}
+}
+
+func TestWhisperReadyRecording(t *testing.T) {
+	original := testWav(t, whisper.SampleRate, 1, 1)
+	want := make([]byte, original.Len())
+	original.ReadAt(want, 0)
+
+	ready, ok := whisperReadyRecording(original)
+	if !ok {
+		t.Fatal("16kHz mono recording wasn't ready for whisper")
+	}
+	got := make([]byte, ready.Len())
+	ready.Read(got)
+	if !bytes.Equal(got, want) {
+		t.Error("16kHz mono recording was changed")
+	}
+
+	for _, test := range []struct {
+		name      string
+		recording *bytes.Reader
+	}{
+		{"8kHz", testWav(t, 8000, 1, 1)},
+		{"stereo", testWav(t, whisper.SampleRate, 2, 1)},
+		{"not a wav", bytes.NewReader([]byte("ID3 not a wav file"))},
+	} {
+		test.recording.Seek(4, 0)
+		if _, ok := whisperReadyRecording(test.recording); ok {
+			t.Errorf("%s: recording was ready for whisper", test.name)
+		}
+		if offset := test.recording.Size() - int64(test.recording.Len()); offset != 0 {
+			t.Errorf("%s: recording left at offset %d, want it rewound", test.name, offset)
+		}
+	}
+}
+
+// A recording whisper can take as it is skips ffmpeg and the resampler
+// entirely, which a missing ffmpeg would otherwise show
+func TestPrepareRecordingSkipsConversion(t *testing.T) {
+	original := testWav(t, whisper.SampleRate, 1, 1)
+	want := make([]byte, original.Len())
+	original.ReadAt(want, 0)
+
+	resamples := func() int64 {
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+		return stats.counts["resample recording"]
+	}
+	before := resamples()
+
+	cfg := config{FfmpegPath: "/nonexistent/ffmpeg", ResampleQuality: 1}
+	prepared, err := prepareRecording(context.Background(), cfg, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, prepared.Len())
+	prepared.Read(got)
+	if !bytes.Equal(got, want) {
+		t.Error("16kHz mono recording was converted")
+	}
+	if resamples() != before {
+		t.Error("16kHz mono recording was resampled")
+	}
+}
+
+// Parses a config from the environment, with just enough set for it to be
+// valid as it is
+func testEnvConfig(t *testing.T, vars map[string]string) config {
+	t.Helper()
+	base := map[string]string{
+		"EXTERNAL_HOSTNAME":  testHostname,
+		"CALLER_WHITELIST":   testCaller,
+		"TWILIO_ACCOUNT_SID": "AC123",
+		"TWILIO_AUTH_TOKEN":  testAuthToken,
+		"STORE_BACKEND":      "markdown",
+		"MARKDOWN_DIR":       t.TempDir(),
+		"MODEL_FILE":         "model.bin",
+	}
+	for key, value := range vars {
+		base[key] = value
+	}
+	for key, value := range base {
+		t.Setenv(key, value)
+	}
+	cfg := config{}
+	if err := env.Parse(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestValidateTranslateToEnglish(t *testing.T) {
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		valid bool
+	}{
+		{"alone", map[string]string{"TRANSLATE_TO_ENGLISH": "true"}, false},
+		{"with language", map[string]string{"TRANSLATE_TO_ENGLISH": "true", "LANGUAGE": "es"}, true},
+		{"with caller languages", map[string]string{"TRANSLATE_TO_ENGLISH": "true", "CALLER_LANGUAGE_MAP": testCaller + "=es"}, true},
+		{"with detection", map[string]string{"TRANSLATE_TO_ENGLISH": "true", "LANGUAGE_DETECT_MODEL": "detect.bin"}, true},
+		{"hosted transcriber", map[string]string{"TRANSLATE_TO_ENGLISH": "true", "LANGUAGE": "es", "TRANSCRIBER": "openai", "OPENAI_API_KEY": "key"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := testEnvConfig(t, test.vars).validate()
+			if test.valid && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			} else if !test.valid && err == nil {
+				t.Error("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+// Writes a CALLER_NOTION_CONFIG file giving each caller a database of their
+// own
+func testNotionConfig(t *testing.T, callers ...string) string {
+	t.Helper()
+	targets := notionTargets{}
+	for _, caller := range callers {
+		targets[caller] = notionTarget{DatabaseId: "database-" + caller}
+	}
+	data, err := json.Marshal(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "targets.json")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateDeletePhrase(t *testing.T) {
+	const otherCaller = "+15557654321"
+	notion := map[string]string{
+		"DELETE_PHRASE":      "delete that",
+		"STORE_BACKEND":      "notion",
+		"NOTION_AUTH_TOKEN":  "token",
+		"NOTION_DATABASE_ID": "database",
+	}
+	with := func(vars map[string]string) map[string]string {
+		for key, value := range notion {
+			if _, ok := vars[key]; !ok {
+				vars[key] = value
+			}
+		}
+		return vars
+	}
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		valid bool
+	}{
+		{"only caller", with(map[string]string{}), true},
+		{"shared database", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller}), false},
+		{"one caller's own database", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller, "CALLER_NOTION_CONFIG": testNotionConfig(t, otherCaller)}), false},
+		{"own databases", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller, "CALLER_NOTION_CONFIG": testNotionConfig(t, testCaller, otherCaller)}), true},
+		{"whitelist disabled", with(map[string]string{"WHITELIST_DISABLED": "true"}), false},
+		{"whitelist disabled with own databases", with(map[string]string{"WHITELIST_DISABLED": "true", "CALLER_NOTION_CONFIG": testNotionConfig(t, testCaller)}), true},
+		{"markdown", map[string]string{"DELETE_PHRASE": "delete that"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testEnvConfig(t, test.vars)
+			cfg.CallerWhitelist = sanitizeCallerWhitelist(cfg.CallerWhitelist)
+			err := cfg.validate()
+			if test.valid && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			} else if !test.valid && err == nil {
+				t.Error("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestValidateGreetWithLastEntry(t *testing.T) {
+	const otherCaller = "+15557654321"
+	notion := map[string]string{
+		"GREET_WITH_LAST_ENTRY": "true",
+		"STORE_BACKEND":         "notion",
+		"NOTION_AUTH_TOKEN":     "token",
+		"NOTION_DATABASE_ID":    "database",
+	}
+	with := func(vars map[string]string) map[string]string {
+		for key, value := range notion {
+			if _, ok := vars[key]; !ok {
+				vars[key] = value
+			}
+		}
+		return vars
+	}
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		valid bool
+	}{
+		{"only caller", with(map[string]string{}), true},
+		{"shared database", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller}), false},
+		{"own databases", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller, "CALLER_NOTION_CONFIG": testNotionConfig(t, testCaller, otherCaller)}), true},
+		{"shared database with index", with(map[string]string{"CALLER_WHITELIST": testCaller + "," + otherCaller, "SQLITE_PATH": "index.db"}), true},
+		{"markdown with index", map[string]string{"GREET_WITH_LAST_ENTRY": "true", "SQLITE_PATH": "index.db"}, true},
+		{"markdown", map[string]string{"GREET_WITH_LAST_ENTRY": "true"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testEnvConfig(t, test.vars)
+			cfg.CallerWhitelist = sanitizeCallerWhitelist(cfg.CallerWhitelist)
+			err := cfg.validate()
+			if test.valid && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			} else if !test.valid && err == nil {
+				t.Error("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestValidateInitialPrompt(t *testing.T) {
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		valid bool
+	}{
+		{"whisper", map[string]string{"INITIAL_PROMPT": "Names: Anouk"}, false},
+		{"openai", map[string]string{"INITIAL_PROMPT": "Names: Anouk", "TRANSCRIBER": "openai", "OPENAI_API_KEY": "key"}, true},
+		{"openai fallback", map[string]string{"INITIAL_PROMPT": "Names: Anouk", "FALLBACK_TRANSCRIBER": "openai", "OPENAI_API_KEY": "key"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := testEnvConfig(t, test.vars).validate()
+			if test.valid && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			} else if !test.valid && err == nil {
+				t.Error("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+// CALLER_WHITELIST can be left out once the whitelist is disabled, but not
+// otherwise
+func TestValidateCallerWhitelist(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprint("disabled=", disabled), func(t *testing.T) {
+			testEnvConfig(t, map[string]string{"WHITELIST_DISABLED": fmt.Sprint(disabled)})
+			os.Unsetenv("CALLER_WHITELIST")
+			var cfg config
+			if err := env.Parse(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.validate()
+			if disabled && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			} else if !disabled && err == nil {
+				t.Error("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestSanitizeForNotion(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "Went for a walk.", "Went for a walk."},
+		{"unicode", "Café, naïve, 日記 ✅", "Café, naïve, 日記 ✅"},
+		{"newlines and tabs", "one\ntwo\tthree", "one\ntwo\tthree"},
+		{"carriage return", "one\r\ntwo", "one\ntwo"},
+		{"null byte", "before\x00after", "beforeafter"},
+		{"escape and bell", "\x1b[31mred\x1b[0m\x07", "[31mred[0m"},
+		{"delete", "a\x7fb", "ab"},
+		{"c1 control", "a\u0085b\u009fc", "abc"},
+		{"invalid byte", "a\xffb", "ab"},
+		{"truncated sequence", "caf\xc3", "caf"},
+		{"overlong encoding", "a\xc0\xafb", "ab"},
+		{"surrogate half", "a\xed\xa0\x80b", "ab"},
+		{"only invalid", "\xff\xfe\x00", ""},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		if got := sanitizeForNotion(test.text); got != test.want {
+			t.Errorf("%s: sanitizeForNotion(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+// Sends the client's requests to the test server rather than Notion
+type testServerTransport struct {
+	server *url.URL
+}
+
+func (t testServerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.server.Scheme, t.server.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestNotionClient(t *testing.T, handler http.Handler) *notion.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notion.NewClient("test-token", notion.WithHTTPClient(&http.Client{
+		Transport: testServerTransport{serverUrl},
+	}))
+}
+
+func TestAppendBlocksBatches(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	client := newTestNotionClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/v1/blocks/page-id/children" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Children []json.RawMessage `json:"children"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		batches = append(batches, len(body.Children))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object": "list", "results": [], "has_more": false}`)
+	}))
+
+	blocks := make([]notion.Block, 250)
+	for i := range blocks {
+		blocks[i] = notion.ParagraphBlock{RichText: []notion.RichText{{Text: &notion.Text{Content: fmt.Sprint(i)}}}}
+	}
+	if err := appendBlocks(context.Background(), client, "page-id", blocks); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(batches) != "[100 100 50]" {
+		t.Errorf("appended batches of %v, want [100 100 50]", batches)
+	}
+}
+
+func TestAppendBlocksStopsAtError(t *testing.T) {
+	requests := 0
+	client := newTestNotionClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"object": "error", "status": 400, "code": "validation_error", "message": "bad block"}`)
+			return
+		}
+		fmt.Fprint(w, `{"object": "list", "results": [], "has_more": false}`)
+	}))
+
+	blocks := make([]notion.Block, 250)
+	for i := range blocks {
+		blocks[i] = notion.ParagraphBlock{RichText: []notion.RichText{{Text: &notion.Text{Content: "x"}}}}
+	}
+	err := appendBlocks(context.Background(), client, "page-id", blocks)
+	if err == nil || !strings.Contains(err.Error(), "bad block") {
+		t.Errorf("appendBlocks() = %v, want the second batch's error", err)
+	}
+	if requests != 2 {
+		t.Errorf("made %d requests, want 2", requests)
+	}
+}
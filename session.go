@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks the page each caller last saved to, so that calling back within the
+// window continues the same page. Sessions are only kept in memory, so a
+// restart starts new pages.
+type notionSessions struct {
+	mu     sync.Mutex
+	window time.Duration
+	pages  map[string]notionSession
+}
+
+type notionSession struct {
+	pageId string
+	at     time.Time
+}
+
+func newNotionSessions(window time.Duration) *notionSessions {
+	return &notionSessions{window: window, pages: map[string]notionSession{}}
+}
+
+// Returns the caller's page if they saved to it within the window
+func (s *notionSessions) current(caller string) (string, bool) {
+	if s.window == 0 {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.pages[caller]
+	if !ok || time.Since(session.at) > s.window {
+		return "", false
+	}
+	return session.pageId, true
+}
+
+// Records that the caller just saved to the page, restarting the window
+func (s *notionSessions) set(caller, pageId string) {
+	if s.window == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[caller] = notionSession{pageId: pageId, at: time.Now()}
+}
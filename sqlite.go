@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// Entries are kept in a plain table, with a full-text index over their titles
+// and bodies whose docids match the table's ids
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	id INTEGER PRIMARY KEY,
+	recording_sid TEXT NOT NULL,
+	date TEXT NOT NULL,
+	recorded_at TEXT NOT NULL,
+	caller TEXT NOT NULL,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	duration_seconds INTEGER NOT NULL
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS entries_fts USING fts4(title, body);
+CREATE TABLE IF NOT EXISTS segments (
+	entry_id INTEGER NOT NULL REFERENCES entries (id),
+	start_seconds REAL NOT NULL,
+	end_seconds REAL NOT NULL,
+	text TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS segments_entry_id ON segments (entry_id);
+`
+
+// Maximum number of results returned by a search
+const maxSearchResults = 50
+
+// A local SQLite copy of every entry, kept for full-text search
+type sqliteStore struct {
+	db           *sql.DB
+	defaultTitle string
+}
+
+func newSQLiteStore(path, defaultTitle string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sqlite failed")
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "create sqlite schema failed")
+	}
+	return &sqliteStore{db: db, defaultTitle: defaultTitle}, nil
+}
+
+func (s *sqliteStore) Save(ctx context.Context, e entry) error {
+	defer timer(ctx, "insert sqlite")()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	title := e.Title
+	if title == "" {
+		title = transcriptTitle(e.Transcript, s.defaultTitle)
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO entries
+		(recording_sid, date, recorded_at, caller, title, body, duration_seconds)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.RecordingSid, e.Date.Format("2006-01-02"), e.RecordedAt.Format(time.RFC3339),
+		e.Caller, title, e.Transcript, int64(e.Duration.Seconds()))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO entries_fts (docid, title, body) VALUES (?, ?, ?)`, id, title, e.Transcript)
+	if err != nil {
+		return err
+	}
+	for _, segment := range e.Segments {
+		_, err := tx.ExecContext(ctx, `INSERT INTO segments (entry_id, start_seconds, end_seconds, text) VALUES (?, ?, ?, ?)`,
+			id, segment.Start, segment.End, segment.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type searchResult struct {
+	RecordingSid string `json:"recording_sid"`
+	Date         string `json:"date"`
+	Caller       string `json:"caller"`
+	Title        string `json:"title"`
+	Snippet      string `json:"snippet"`
+}
+
+// Returns the most recent entries matching the full-text query, which uses
+// SQLite's FTS syntax
+func (s *sqliteStore) search(ctx context.Context, q string) ([]searchResult, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT e.recording_sid, e.date, e.caller, e.title, snippet(entries_fts)
+		FROM entries_fts JOIN entries e ON e.id = entries_fts.docid
+		WHERE entries_fts MATCH ?
+		ORDER BY e.recorded_at DESC
+		LIMIT ?`, q, maxSearchResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []searchResult{}
+	for rows.Next() {
+		var r searchResult
+		if err := rows.Scan(&r.RecordingSid, &r.Date, &r.Caller, &r.Title, &r.Snippet); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// Reports whether any entries from the caller have been saved
+func (s *sqliteStore) hasEntries(ctx context.Context, caller string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM entries WHERE caller = ?)`, caller).Scan(&exists)
+	return exists, err
+}
+
+// Returns the title of the caller's most recent entry, or errNoEntries if
+// they haven't saved one
+func (s *sqliteStore) latestTitle(ctx context.Context, caller string) (string, error) {
+	var title string
+	err := s.db.QueryRowContext(ctx, `SELECT title FROM entries WHERE caller = ? ORDER BY recorded_at DESC, id DESC LIMIT 1`, caller).Scan(&title)
+	if err == sql.ErrNoRows {
+		return "", errNoEntries
+	}
+	return title, err
+}
+
+// Merges the full-text index's segments and rebuilds the database file to
+// reclaim space, returning the number of pages reclaimed. SQLite holds a
+// write lock while vacuuming, so saves wait rather than fail.
+func (s *sqliteStore) vacuum(ctx context.Context) (int64, error) {
+	defer timer(ctx, "vacuum sqlite")()
+
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO entries_fts (entries_fts) VALUES ('optimize')`); err != nil {
+		return 0, errors.Wrap(err, "optimize full-text index failed")
+	}
+	var free int64
+	if err := s.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&free); err != nil {
+		return 0, err
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return 0, errors.Wrap(err, "vacuum failed")
+	}
+	return free, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
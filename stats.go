@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Times every transcriber under the same name, so the summary's average
+// covers whichever is configured, fallbacks and translation passes included
+const transcriptionTimer = "transcription"
+
+// Counters for the current run, logged on shutdown for a quick picture of how
+// the run went
+type runStats struct {
+	processed atomic.Int64
+	saved     atomic.Int64
+
+	mu       sync.Mutex
+	failures map[string]int64
+	// Total time and count of each timed operation, keyed by timer name
+	durations map[string]time.Duration
+	counts    map[string]int64
+}
+
+var stats = &runStats{
+	failures:  map[string]int64{},
+	durations: map[string]time.Duration{},
+	counts:    map[string]int64{},
+}
+
+func (s *runStats) fail(stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[stage]++
+}
+
+func (s *runStats) observe(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durations[name] += d
+	s.counts[name]++
+}
+
+func (s *runStats) average(name string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[name] == 0 {
+		return 0
+	}
+	return s.durations[name] / time.Duration(s.counts[name])
+}
+
+func (s *runStats) log(ctx context.Context) {
+	s.mu.Lock()
+	stages := make([]string, 0, len(s.failures))
+	for stage, n := range s.failures {
+		stages = append(stages, fmt.Sprintf("%s=%d", stage, n))
+	}
+	s.mu.Unlock()
+	sort.Strings(stages)
+	if len(stages) == 0 {
+		stages = append(stages, "none")
+	}
+
+	logf(ctx, "Run summary: %d recordings processed, %d entries saved, failures: %s, average transcription time %v",
+		s.processed.Load(), s.saved.Load(), strings.Join(stages, ", "),
+		s.average(transcriptionTimer).Round(time.Millisecond))
+}
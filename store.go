@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A backend that journal entries are saved to
+type TranscriptStore interface {
+	Save(ctx context.Context, e entry) error
+}
+
+func newStore(cfg config) (TranscriptStore, error) {
+	var stores multiStore
+	for _, backend := range cfg.StoreBackends {
+		var store TranscriptStore
+		switch backend {
+		case "notion":
+			store = &NotionStore{cfg: cfg, sessions: newNotionSessions(cfg.SessionWindow)}
+		case "markdown":
+			var err error
+			if store, err = newMarkdownStore(cfg.MarkdownDir, cfg.DefaultTitle); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported store backend: %q", backend)
+		}
+		stores = append(stores, namedStore{backend, store})
+	}
+	if len(stores) == 1 {
+		return stores[0].store, nil
+	}
+	return stores, nil
+}
+
+// Whether entries are saved to the named backend, possibly among others
+func (cfg config) usesStore(backend string) bool {
+	for _, b := range cfg.StoreBackends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+type namedStore struct {
+	name  string
+	store TranscriptStore
+}
+
+// Saves each entry to every one of several stores, for redundancy. An entry
+// only fails to save if every store fails, so that one store being down
+// doesn't hold up the others or have the entry retried into all of them.
+type multiStore []namedStore
+
+func (s multiStore) Save(ctx context.Context, e entry) error {
+	var failures []string
+	for _, named := range s {
+		if err := named.store.Save(ctx, e); err != nil {
+			logf(ctx, "save to %s failed: %v", named.name, err)
+			failures = append(failures, named.name+": "+err.Error())
+		}
+	}
+	if len(failures) == len(s) {
+		return errors.New("every store failed: " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Uploads entries as Notion pages. With a session window, an entry from a
+// caller who called shortly before is appended to their last page instead.
+type NotionStore struct {
+	cfg      config
+	sessions *notionSessions
+}
+
+func (s *NotionStore) Save(ctx context.Context, e entry) error {
+	if e.PlaceholderPageId != "" {
+		err := fillPlaceholder(ctx, s.cfg, e.PlaceholderPageId, e)
+		if err == nil {
+			s.sessions.set(e.Caller, e.PlaceholderPageId)
+			return nil
+		} else if err != errPlaceholderGone {
+			return err
+		}
+		logf(ctx, "Placeholder %s is gone, saving the entry as usual", e.PlaceholderPageId)
+		e.PlaceholderPageId = ""
+	}
+
+	if pageId, ok := s.sessions.current(e.Caller); ok {
+		err := appendTranscript(ctx, s.cfg, pageId, e)
+		if err == nil {
+			s.sessions.set(e.Caller, pageId)
+			return nil
+		}
+		// The page may have been deleted since, so start a new one
+		logf(ctx, "append to session page failed, creating a new page: %v", err)
+	}
+
+	pageId, err := uploadTranscript(ctx, s.cfg, e)
+	if err != nil {
+		return err
+	}
+	s.sessions.set(e.Caller, pageId)
+	return nil
+}
+
+// Writes entries as Markdown files with YAML front matter, one per entry, into
+// a directory such as an Obsidian vault
+type MarkdownStore struct {
+	dir          string
+	defaultTitle string
+}
+
+func newMarkdownStore(dir, defaultTitle string) (*MarkdownStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create markdown dir failed")
+	}
+	return &MarkdownStore{dir: dir, defaultTitle: defaultTitle}, nil
+}
+
+func (s *MarkdownStore) Save(ctx context.Context, e entry) error {
+	defer timer(ctx, "write markdown")()
+
+	// Named by the entry's date and the time it was recorded, so that files
+	// sort chronologically, with a suffix if two entries share a second
+	name := e.Date.Format("2006-01-02") + "-" + e.RecordedAt.Format("150405")
+	for i := 1; ; i++ {
+		filename := name + ".md"
+		if i > 1 {
+			filename = fmt.Sprintf("%s-%d.md", name, i)
+		}
+		file, err := os.OpenFile(filepath.Join(s.dir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, err = file.WriteString(markdownEntry(e, s.defaultTitle))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+func markdownEntry(e entry, defaultTitle string) string {
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	fmt.Fprintf(&sb, "title: %s\n", strconv.Quote(entryTitle(e, defaultTitle)))
+	fmt.Fprintf(&sb, "date: %s\n", e.Date.Format("2006-01-02"))
+	fmt.Fprintf(&sb, "recorded_at: %s\n", e.RecordedAt.Format("2006-01-02T15:04:05Z07:00"))
+	if e.Caller != "" {
+		fmt.Fprintf(&sb, "caller: %s\n", strconv.Quote(e.Caller))
+	}
+	if e.Duration > 0 {
+		fmt.Fprintf(&sb, "duration: %s\n", e.Duration)
+	}
+	if e.Language != "" {
+		fmt.Fprintf(&sb, "language: %s\n", e.Language)
+	}
+	if e.LowConfidence {
+		sb.WriteString("low_confidence: true\n")
+	}
+	sb.WriteString("---\n\n")
+	if e.Summary != "" {
+		sb.WriteString("> " + strings.ReplaceAll(strings.TrimSpace(e.Summary), "\n", "\n> "))
+		sb.WriteString("\n\n")
+	}
+	sb.WriteString(strings.TrimSpace(e.Transcript))
+	sb.WriteString("\n")
+	if e.OriginalTranscript != "" {
+		fmt.Fprintf(&sb, "\n## Original (%s)\n\n", e.Language)
+		sb.WriteString(strings.TrimSpace(e.OriginalTranscript))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
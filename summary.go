@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/go-notion"
+)
+
+// Prefix of daily summary page titles, also used to keep earlier summaries
+// out of the day's entries
+const summaryTitlePrefix = "Daily summary: "
+
+// Creates a summary page linking to the day's entries every day at the given
+// time ("15:04") in the configured time zone
+func runDailySummaries(cfg config, at time.Time) {
+	loc := cfg.Timezone.loc()
+	for {
+		now := time.Now().In(loc)
+		next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		time.Sleep(time.Until(next))
+
+		ctx := context.Background()
+		if err := createDailySummary(ctx, cfg, next); err != nil {
+			logf(ctx, "create daily summary failed: %v", err)
+		}
+	}
+}
+
+func createDailySummary(ctx context.Context, cfg config, day time.Time) error {
+	defer timer(ctx, "create daily summary")()
+
+	notionClient := cfg.notionClient(cfg.NotionAuthToken)
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	query := &notion.DatabaseQuery{
+		Filter: &notion.DatabaseQueryFilter{
+			Property: "Date",
+			DatabaseQueryPropertyFilter: notion.DatabaseQueryPropertyFilter{
+				Date: &notion.DatePropertyFilter{Equals: &date},
+			},
+		},
+		Sorts: []notion.DatabaseQuerySort{
+			{Timestamp: notion.SortTimeStampCreatedTime, Direction: notion.SortDirAsc},
+		},
+	}
+
+	var links []notion.Block
+	for {
+		result, err := notionClient.QueryDatabase(ctx, cfg.NotionDatabaseId, query)
+		if err != nil {
+			return err
+		}
+		for _, page := range result.Results {
+			if strings.HasPrefix(pageTitle(page), summaryTitlePrefix) {
+				continue
+			}
+			links = append(links, notion.LinkToPageBlock{
+				Type:   notion.LinkToPageTypePageID,
+				PageID: page.ID,
+			})
+		}
+		if !result.HasMore || result.NextCursor == nil {
+			break
+		}
+		query.StartCursor = *result.NextCursor
+	}
+
+	if len(links) == 0 {
+		logf(ctx, "No entries for %s, skipping daily summary", day.Format("2006-01-02"))
+		return nil
+	}
+
+	title := summaryTitlePrefix + cfg.Locale.day(day)
+	_, err := notionClient.CreatePage(ctx, notion.CreatePageParams{
+		ParentType: notion.ParentTypeDatabase,
+		ParentID:   cfg.NotionDatabaseId,
+		DatabasePageProperties: &notion.DatabasePageProperties{
+			"Date": notion.DatabasePageProperty{
+				Date: &notion.Date{Start: notion.NewDateTime(day, false)},
+			},
+			"Title": notion.DatabasePageProperty{
+				Title: []notion.RichText{{Text: &notion.Text{Content: title}}},
+			},
+		},
+		Children: links,
+	})
+	return err
+}
+
+// Returns the plain text title of a database page
+func pageTitle(page notion.Page) string {
+	properties, ok := page.Properties.(notion.DatabasePageProperties)
+	if !ok {
+		return ""
+	}
+	var sb strings.Builder
+	for _, richText := range properties["Title"].Title {
+		sb.WriteString(richText.PlainText)
+	}
+	return sb.String()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Where a caller's entries are uploaded in Notion
+type notionTarget struct {
+	Token      string `json:"token"`
+	DatabaseId string `json:"database_id"`
+	PageId     string `json:"page_id"`
+}
+
+// Notion targets keyed by caller number, loaded from the JSON file named in the
+// config, e.g. {"+15551234567": {"token": "...", "database_id": "..."}}
+type notionTargets map[string]notionTarget
+
+func (t *notionTargets) UnmarshalText(path []byte) error {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return err
+	}
+	// Converted so that the map's own UnmarshalText isn't used for the
+	// JSON, which would expect a string
+	return json.Unmarshal(data, (*map[string]notionTarget)(t))
+}
+
+// Returns the caller's Notion target, filling in anything the caller's
+// config leaves out from the global config
+func (cfg config) notionTarget(caller string) notionTarget {
+	target := cfg.CallerNotionConfig[caller]
+	if target.Token == "" {
+		target.Token = cfg.NotionAuthToken
+	}
+	if target.DatabaseId == "" {
+		target.DatabaseId = cfg.NotionDatabaseId
+	}
+	if target.PageId == "" {
+		target.PageId = cfg.NotionPageId
+	}
+	return target
+}
+
+// Reports whether no other caller's entries go to the caller's Notion target:
+// either they have one of their own, or they're the only number on the
+// whitelist and so the only one using the default
+func (cfg config) ownsNotionTarget(caller string) bool {
+	if _, ok := cfg.CallerNotionConfig[caller]; ok {
+		return true
+	}
+	return !cfg.WhitelistDisabled && len(cfg.CallerWhitelist) == 1 && cfg.CallerWhitelist[0] == caller
+}
+
+// Returns an error naming the setting if a whitelisted caller's Notion
+// target is shared, since entries there don't record who made them. With
+// the whitelist disabled, at least one caller needs a target of their own.
+func (cfg config) validateOwnedTargets(setting string) error {
+	if cfg.WhitelistDisabled {
+		if len(cfg.CallerNotionConfig) == 0 {
+			return fmt.Errorf("%s requires CALLER_NOTION_CONFIG when the whitelist is disabled", setting)
+		}
+		return nil
+	}
+	for _, caller := range cfg.CallerWhitelist {
+		if !cfg.ownsNotionTarget(caller) {
+			return fmt.Errorf("%s requires a CALLER_NOTION_CONFIG target for %s, unless they're the only whitelisted caller", setting, caller)
+		}
+	}
+	return nil
+}
+
+// Values keyed by caller number, parsed from a list like
+// "+15551234567=en,+15557654321=es"
+type callerMap map[string]string
+
+func (m *callerMap) UnmarshalText(text []byte) error {
+	values := callerMap{}
+	for _, pair := range strings.Split(string(text), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		caller, value, ok := strings.Cut(pair, "=")
+		caller, value = strings.TrimSpace(caller), strings.TrimSpace(value)
+		if !ok || caller == "" || value == "" {
+			return fmt.Errorf("invalid caller setting %q, expected number=value", pair)
+		}
+		values[caller] = value
+	}
+	*m = values
+	return nil
+}
+
+func (m callerMap) values() []string {
+	var values []string
+	for _, value := range m {
+		values = append(values, value)
+	}
+	return values
+}
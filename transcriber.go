@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+)
+
+// A speech-to-text engine. Recordings are given to it prepared, as 16kHz mono
+// WAV, which both local models and hosted APIs can take.
+type Transcriber interface {
+	// Returns the transcript, or a truncatedError along with whatever was
+	// transcribed before the engine failed
+	Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error)
+}
+
+// A Transcriber that can fetch recordings from Twilio itself, so that they
+// needn't be downloaded and prepared first
+type urlTranscriber interface {
+	Transcriber
+	TranscribeUrl(ctx context.Context, recordingUrl string, opts transcribeOptions) (transcriptResult, error)
+	// Whether it's configured to
+	fetchesRecordings() bool
+}
+
+// Returns the engine named by TRANSCRIBER, falling back to the one named by
+// FALLBACK_TRANSCRIBER if it fails
+func newTranscriber(cfg config, models *modelHolder) (Transcriber, error) {
+	primary, err := newNamedTranscriber(cfg.Transcriber, cfg, models)
+	if err != nil || cfg.FallbackTranscriber == "" {
+		return primary, err
+	}
+	fallback, err := newNamedTranscriber(cfg.FallbackTranscriber, cfg, models)
+	if err != nil {
+		return nil, err
+	}
+	return fallbackTranscriber{primary, fallback, cfg.TranscribeTimeout}, nil
+}
+
+func newNamedTranscriber(name string, cfg config, models *modelHolder) (Transcriber, error) {
+	switch name {
+	case "whisper":
+		t := whisperTranscriber{models: models, parallelism: cfg.WhisperParallelism, translate: cfg.TranslateToEnglish}
+		if cfg.LanguageDetectModel != "" {
+			detector, err := newLanguageDetector(cfg.LanguageDetectModel)
+			if err != nil {
+				return nil, err
+			}
+			t.detector = detector
+		}
+		return t, nil
+	case "openai":
+		return openAITranscriber{
+			url:    cfg.OpenAIUrl,
+			apiKey: cfg.OpenAIApiKey,
+			model:  cfg.OpenAIModel,
+			client: cfg.speechHTTPClient(),
+		}, nil
+	case "deepgram":
+		return deepgramTranscriber{
+			apiKey:      cfg.DeepgramApiKey,
+			model:       cfg.DeepgramModel,
+			smartFormat: cfg.DeepgramSmartFormat,
+			punctuate:   cfg.DeepgramPunctuate,
+			fromTwilio:  cfg.DeepgramFromTwilio,
+			client:      cfg.speechHTTPClient(),
+		}, nil
+	case "gcp":
+		creds, err := findGcpCredentials(cfg.httpClient())
+		if err != nil {
+			return nil, err
+		}
+		return gcpTranscriber{
+			creds:        creds,
+			model:        cfg.GcpModel,
+			languageCode: cfg.GcpLanguageCode,
+			punctuation:  cfg.GcpPunctuation,
+			client:       cfg.speechHTTPClient(),
+		}, nil
+	case "azure":
+		return azureTranscriber{
+			region:       cfg.AzureSpeechRegion,
+			key:          cfg.AzureSpeechKey,
+			locale:       cfg.AzureSpeechLocale,
+			conversation: cfg.AzureConversation,
+			client:       cfg.speechHTTPClient(),
+		}, nil
+	case "vosk":
+		return voskTranscriber{cfg.VoskUrl}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transcriber: %q", name)
+	}
+}
+
+// Transcribes with the local whisper.cpp model
+type whisperTranscriber struct {
+	models *modelHolder
+	// Most model instances a recording's chunks are spread across
+	parallelism int
+	// If set, picks the language when none is configured for the caller
+	detector *languageDetector
+	// Whether recordings in other languages are translated into English,
+	// keeping the original transcript as well
+	translate bool
+}
+
+func (t whisperTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	var result transcriptResult
+	err := t.models.use(t.parallelism, func(models []whisper.Model) (err error) {
+		model := models[0]
+		// English-only models can't be given another language
+		if opts.Language == "" && t.detector != nil && model.IsMultilingual() {
+			language, p, err := t.detector.detect(recording)
+			if err != nil {
+				logf(ctx, "detect language failed, using model default: %v", err)
+			} else {
+				logf(ctx, "Detected language %s (p=%.2f)", language, p)
+				opts.Language = language
+			}
+		}
+		if !t.translate || !model.IsMultilingual() {
+			result, err = transcribeRecording(ctx, models, recording, opts)
+			return err
+		}
+
+		// The original is transcribed first, to find out whether there's
+		// anything to translate. Segments are only reported for the
+		// translation.
+		original := opts
+		original.OnSegment = nil
+		result, err = transcribeRecording(ctx, models, recording, original)
+		if err != nil || result.Language == "en" || result.Language == "" {
+			return err
+		}
+		if _, err := recording.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		logf(ctx, "Translating from %s", result.Language)
+		opts.Language, opts.Translate = result.Language, true
+		translation, err := transcribeRecording(ctx, models, recording, opts)
+		if err != nil {
+			// The original is better than a partial translation
+			logf(ctx, "translate recording failed, keeping original: %v", err)
+			return nil
+		}
+		translation.Original = result.Text
+		result = translation
+		return nil
+	})
+	return result, err
+}
+
+// Transcribes with a second engine when the first fails or takes too long, so
+// that a call still ends up as an entry
+type fallbackTranscriber struct {
+	primary  Transcriber
+	fallback Transcriber
+	// How long the primary gets, or zero for as long as it takes
+	timeout time.Duration
+}
+
+func (t fallbackTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	result, err := t.transcribePrimary(ctx, recording, opts)
+	if _, ok := err.(truncatedError); ok && result.Text != "" {
+		return result, err
+	} else if err == nil || ctx.Err() != nil {
+		return result, err
+	}
+	logf(ctx, "Transcribing with fallback: %v", err)
+	if _, err := recording.Seek(0, io.SeekStart); err != nil {
+		return transcriptResult{}, err
+	}
+	return t.fallback.Transcribe(ctx, recording, opts)
+}
+
+func (t fallbackTranscriber) transcribePrimary(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	if t.timeout == 0 {
+		return t.primary.Transcribe(ctx, recording, opts)
+	}
+
+	// The local model can't be interrupted, so it's left to finish in the
+	// background on its own copy of the recording, and its result dropped
+	type outcome struct {
+		result transcriptResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	data, err := ioutil.ReadAll(io.NewSectionReader(recording, 0, recording.Size()))
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	go func() {
+		result, err := t.primary.Transcribe(timeoutCtx, bytes.NewReader(data), opts)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timeoutCtx.Done():
+		if ctx.Err() != nil {
+			return transcriptResult{}, ctx.Err()
+		}
+		return transcriptResult{}, fmt.Errorf("transcription took longer than %v", t.timeout)
+	}
+}
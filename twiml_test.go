@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/twilio/twilio-go/client"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+const (
+	testAuthToken = "test-auth-token"
+	testHostname  = "journal.example.com"
+	testCaller    = "+15551234567"
+)
+
+// Mirrors the Twilio routes set up in main
+func newTwilioRouter(cfg config) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	validator := client.NewRequestValidator(testAuthToken)
+	twilio := router.Group("/", parseTwilioForm(),
+		checkTwilioSignature(&validator, cfg.ExternalHostname, false, nil),
+		checkCallerWhitelist(cfg.CallerWhitelist, cfg.WhitelistDisabled))
+	twilio.POST("/call", callHandler(cfg, nil))
+	twilio.POST(recordedPath, recordedHandler(cfg, newCancelledCalls()))
+	return router
+}
+
+// Signs the form the way Twilio does: the URL followed by each parameter's
+// name and value in order of name, hashed with the auth token
+func twilioSignature(u string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := u
+	for _, key := range keys {
+		data += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(testAuthToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func postTwilio(router *gin.Engine, path string, form url.Values, sign bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "https://"+testHostname+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if sign {
+		req.Header.Set("X-Twilio-Signature", twilioSignature("https://"+testHostname+path, form))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func testTwilioConfig() config {
+	return config{
+		ExternalHostname: testHostname,
+		CallerWhitelist:  []string{testCaller},
+	}
+}
+
+// Re-encodes the TwiML with each element's attributes sorted, since the
+// twiml package writes them in map order
+func canonicalTwiML(t *testing.T, doc string) string {
+	t.Helper()
+	var b strings.Builder
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	encoder := xml.NewEncoder(&b)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("parse TwiML failed: %v\n%s", err, doc)
+		}
+		switch token := token.(type) {
+		case xml.ProcInst:
+			continue
+		case xml.StartElement:
+			sort.Slice(token.Attr, func(i, j int) bool {
+				return token.Attr[i].Name.Local < token.Attr[j].Name.Local
+			})
+		}
+		if err := encoder.EncodeToken(xml.CopyToken(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String() + "\n"
+}
+
+func checkGolden(t *testing.T, name, actual string) {
+	t.Helper()
+	actual = canonicalTwiML(t, actual)
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(actual), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != string(expected) {
+		t.Errorf("TwiML doesn't match %s\ngot:\n%s\nwant:\n%s", path, actual, expected)
+	}
+}
+
+func TestTwiML(t *testing.T) {
+	closed := hourRange{}
+	if err := closed.UnmarshalText([]byte("00:00-00:00")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		form   url.Values
+		config func(*config)
+		golden string
+	}{
+		{
+			name:   "call",
+			path:   "/call",
+			form:   url.Values{"From": {testCaller}, "CallSid": {"CA123"}},
+			golden: "call.xml",
+		},
+		{
+			name: "call with name",
+			path: "/call",
+			form: url.Values{"From": {testCaller}, "CallSid": {"CA123"}},
+			config: func(cfg *config) {
+				cfg.CallerNameMap = callerMap{testCaller: "Sam"}
+			},
+			golden: "call_name.xml",
+		},
+		{
+			name: "call with twilio transcription",
+			path: "/call",
+			form: url.Values{"From": {testCaller}, "CallSid": {"CA123"}},
+			config: func(cfg *config) {
+				cfg.TwilioTranscribe = true
+			},
+			golden: "call_transcribe.xml",
+		},
+		{
+			name: "call with cancel key",
+			path: "/call",
+			form: url.Values{"From": {testCaller}, "CallSid": {"CA123"}},
+			config: func(cfg *config) {
+				cfg.CancelKey = "*"
+			},
+			golden: "call_cancel_key.xml",
+		},
+		{
+			name: "call outside allowed hours",
+			path: "/call",
+			form: url.Values{"From": {testCaller}, "CallSid": {"CA123"}},
+			config: func(cfg *config) {
+				cfg.AllowedHours = closed
+			},
+			golden: "call_closed.xml",
+		},
+		{
+			name:   "call from unknown caller",
+			path:   "/call",
+			form:   url.Values{"From": {"+15550000000"}, "CallSid": {"CA123"}},
+			golden: "call_rejected.xml",
+		},
+		{
+			name:   "recorded",
+			path:   recordedPath,
+			form:   url.Values{"From": {testCaller}, "CallSid": {"CA123"}, "RecordingSid": {"RE123"}, "Digits": {"hangup"}},
+			golden: "recorded.xml",
+		},
+		{
+			name: "recorded with cancel key",
+			path: recordedPath,
+			form: url.Values{"From": {testCaller}, "CallSid": {"CA123"}, "RecordingSid": {"RE123"}, "Digits": {"*"}},
+			config: func(cfg *config) {
+				cfg.CancelKey = "*"
+			},
+			golden: "recorded_cancelled.xml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testTwilioConfig()
+			if test.config != nil {
+				test.config(&cfg)
+			}
+			w := postTwilio(newTwilioRouter(cfg), test.path, test.form, true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "text/xml" {
+				t.Errorf("Content-Type = %q, want text/xml", contentType)
+			}
+			checkGolden(t, test.golden, w.Body.String())
+		})
+	}
+}
+
+func TestTwiMLRejectsUnsignedRequests(t *testing.T) {
+	router := newTwilioRouter(testTwilioConfig())
+	form := url.Values{"From": {testCaller}, "CallSid": {"CA123"}}
+
+	if w := postTwilio(router, "/call", form, false); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://"+testHostname+"/call", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", twilioSignature("https://"+testHostname+"/call", url.Values{"From": {"+15550000000"}}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("mismatched signature status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Shortest vocabulary entry, in letters, that is matched at all.
+// Shorter words are too easily confused with ordinary ones.
+const minVocabularyLetters = 4
+
+// Respells near misses of the vocabulary's names and jargon in the
+// transcript, for transcribers that can't be told about them up front. A run
+// of words is replaced when, ignoring case and punctuation, it's within an
+// edit per five letters of an entry with as many words, so that "Jon Smyth"
+// becomes "John Smith". Entries shorter than five letters only have their case
+// fixed, since "Kate" is a single edit away from "late". Newlines are kept.
+func correctVocabulary(transcript string, vocabulary []string) string {
+	var entries [][]string
+	for _, entry := range vocabulary {
+		if words := strings.Fields(entry); len(words) > 0 && len(vocabularyKey(words)) >= minVocabularyLetters {
+			entries = append(entries, words)
+		}
+	}
+	if len(entries) == 0 {
+		return transcript
+	}
+	// Longer entries first, so that "Mary Ann" wins over "Mary"
+	sort.SliceStable(entries, func(i, j int) bool {
+		return len(entries[i]) > len(entries[j])
+	})
+
+	lines := strings.Split(transcript, "\n")
+	for i, line := range lines {
+		words := strings.Fields(line)
+		var corrected []string
+		for len(words) > 0 {
+			n, replacement := matchVocabulary(words, entries)
+			corrected = append(corrected, replacement...)
+			words = words[n:]
+		}
+		lines[i] = strings.Join(corrected, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the number of words at the start of words that match an entry, and
+// what they should be replaced with. The first word is returned as is if
+// nothing matches.
+func matchVocabulary(words []string, entries [][]string) (int, []string) {
+	for _, entry := range entries {
+		if len(entry) > len(words) {
+			continue
+		}
+		window := words[:len(entry)]
+		key, want := vocabularyKey(window), vocabularyKey(entry)
+		if editDistance(strings.ToLower(key), strings.ToLower(want)) > len([]rune(want))/5 {
+			continue
+		}
+		// Punctuation and possessives around the run stay where they were
+		lead, _, _ := splitWord(window[0])
+		_, _, trail := splitWord(window[len(window)-1])
+		replacement := append([]string(nil), entry...)
+		replacement[0] = lead + replacement[0]
+		replacement[len(entry)-1] += trail
+		return len(entry), replacement
+	}
+	return 1, words[:1]
+}
+
+// Joins the words without their surrounding punctuation and possessives
+func vocabularyKey(words []string) string {
+	cores := make([]string, len(words))
+	for i, word := range words {
+		_, cores[i], _ = splitWord(word)
+	}
+	return strings.Join(cores, " ")
+}
+
+// Splits the punctuation before and after a word from it, counting a
+// possessive as trailing punctuation
+func splitWord(word string) (lead, core, trail string) {
+	core = strings.TrimLeftFunc(word, unicode.IsPunct)
+	lead = word[:len(word)-len(core)]
+	core = strings.TrimRightFunc(core, unicode.IsPunct)
+	for _, possessive := range []string{"'s", "’s"} {
+		if strings.HasSuffix(strings.ToLower(core), possessive) {
+			core = core[:len(core)-len(possessive)]
+			break
+		}
+	}
+	return lead, core, word[len(lead)+len(core):]
+}
+
+// Levenshtein distance between two strings, in runes
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	gwav "github.com/go-audio/wav"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// Audio is streamed to Vosk in chunks of a quarter second
+const voskChunkBytes = whisper.SampleRate / 4 * 2
+
+// Transcribes with a Vosk server, which is small enough to run alongside the
+// journal and serve as a fallback when the main transcriber fails
+type voskTranscriber struct {
+	url string
+}
+
+type voskResponse struct {
+	Text   string `json:"text"`
+	Result []struct {
+		Conf float64 `json:"conf"`
+	} `json:"result"`
+}
+
+// Vosk's models are fixed to a language, so none of the options are passed on
+func (t voskTranscriber) Transcribe(ctx context.Context, recording *bytes.Reader, opts transcribeOptions) (transcriptResult, error) {
+	defer timer(ctx, "vosk transcription")()
+
+	dec := gwav.NewDecoder(io.NewSectionReader(recording, 0, recording.Size()))
+	if err := dec.FwdToPCM(); err != nil {
+		return transcriptResult{}, errors.Wrap(err, "read wav failed")
+	}
+	if dec.BitDepth != 16 || dec.NumChans != whisperNumChans {
+		return transcriptResult{}, fmt.Errorf("unsupported wav format: %d-bit, %d channels", dec.BitDepth, dec.NumChans)
+	}
+
+	config, err := websocket.NewConfig(t.url, "http://localhost/")
+	if err != nil {
+		return transcriptResult{}, err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return transcriptResult{}, errors.Wrap(err, "connect to vosk failed")
+	}
+	defer ws.Close()
+	// Closing the connection unblocks any read or write in progress
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-stop:
+		}
+	}()
+
+	err = websocket.JSON.Send(ws, map[string]interface{}{
+		"config": map[string]interface{}{"sample_rate": dec.SampleRate, "words": 1},
+	})
+	if err != nil {
+		return transcriptResult{}, err
+	}
+
+	// Vosk answers every chunk, with a final result whenever it hears the end
+	// of an utterance and a partial one otherwise
+	var texts []string
+	var confidence float64
+	var words int
+	receive := func() error {
+		var res voskResponse
+		if err := websocket.JSON.Receive(ws, &res); err != nil {
+			return errors.Wrap(err, "receive from vosk failed")
+		}
+		if text := strings.TrimSpace(res.Text); text != "" {
+			texts = append(texts, text)
+		}
+		for _, word := range res.Result {
+			confidence += word.Conf
+			words++
+		}
+		return nil
+	}
+	chunk := make([]byte, voskChunkBytes)
+	for {
+		n, err := io.ReadFull(dec.PCMChunk, chunk)
+		if n > 0 {
+			if err := websocket.Message.Send(ws, chunk[:n]); err != nil {
+				return transcriptResult{}, err
+			}
+			if err := receive(); err != nil {
+				return transcriptResult{}, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return transcriptResult{}, err
+		}
+	}
+	if err := websocket.JSON.Send(ws, map[string]int{"eof": 1}); err != nil {
+		return transcriptResult{}, err
+	}
+	if err := receive(); err != nil {
+		return transcriptResult{}, err
+	}
+
+	if words == 0 {
+		confidence = 1
+	} else {
+		confidence /= float64(words)
+	}
+	return transcriptResult{Text: strings.Join(texts, " "), Confidence: confidence}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// The entry as sent to the transcript webhook. The webhook may respond with a
+// modified copy, e.g. with corrected text or a summary filled in.
+type webhookPayload struct {
+	Text      string    `json:"text"`
+	Caller    string    `json:"caller"`
+	Timestamp time.Time `json:"timestamp"`
+	Summary   string    `json:"summary,omitempty"`
+	// Sent for reference. Changes to them in the response are ignored.
+	Segments []timedSegment `json:"segments,omitempty"`
+}
+
+// Posts the entry to the transcript webhook and applies whatever it sends
+// back. An empty response leaves the entry as it was.
+func enrichEntry(ctx context.Context, cfg config, e entry) (entry, error) {
+	defer timer(ctx, "call transcript webhook")()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.TranscriptWebhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(webhookPayload{
+		Text:      e.Transcript,
+		Caller:    e.Caller,
+		Timestamp: e.RecordedAt,
+		Segments:  e.Segments,
+	})
+	if err != nil {
+		return e, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.TranscriptWebhook, bytes.NewReader(body))
+	if err != nil {
+		return e, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Bounded by TRANSCRIPT_WEBHOOK_TIMEOUT through ctx rather than the
+	// client, which would also apply HTTP_TIMEOUT to the whole request
+	client := &http.Client{Transport: cfg.httpTransport()}
+	res, err := client.Do(req)
+	if err != nil {
+		return e, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return e, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return e, err
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return e, err
+	}
+	if payload.Text != "" {
+		e.Transcript = payload.Text
+	}
+	e.Summary = payload.Summary
+	return e, nil
+}